@@ -4,8 +4,11 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"github.com/busoc/glob"
 	"github.com/busoc/sizefmt"
@@ -15,6 +18,10 @@ type setter interface {
 	setVerbose(bool)
 	setPretty(bool)
 	setError(bool)
+	setFS(fs.FS)
+	setCache(*Cache)
+	setProgress(*Progress)
+	setPlan(*Plan)
 }
 
 type Option func(setter)
@@ -37,6 +44,32 @@ func WithError(err bool) Option {
 	}
 }
 
+func WithFS(fsys fs.FS) Option {
+	return func(s setter) {
+		s.setFS(fsys)
+	}
+}
+
+func WithCache(c *Cache) Option {
+	return func(s setter) {
+		s.setCache(c)
+	}
+}
+
+func WithProgress(p *Progress) Option {
+	return func(s setter) {
+		s.setProgress(p)
+	}
+}
+
+// WithPlan makes the scanner report in p the files that it would copy to or
+// delete from the server instead of copying or deleting them.
+func WithPlan(p *Plan) Option {
+	return func(s setter) {
+		s.setPlan(p)
+	}
+}
+
 func FormatSize(z float64) string {
 	return sizefmt.FormatIEC(z, false)
 }
@@ -100,6 +133,8 @@ type FileInfo struct {
 	Curr []byte
 	Raw  uint16
 	File string
+
+	fsys fs.FS
 }
 
 func FetchInfos(rs io.Reader, length int) <-chan FileInfo {
@@ -131,10 +166,13 @@ func FetchInfos(rs io.Reader, length int) <-chan FileInfo {
 type Entry struct {
 	File string
 	Size float64
+
+	fsys fs.FS
+	info fs.FileInfo
 }
 
 func (e Entry) Compute(w io.Writer) error {
-	r, err := os.Open(e.File)
+	r, err := openFile(e.fsys, e.File)
 	if err != nil {
 		return err
 	}
@@ -145,29 +183,46 @@ func (e Entry) Compute(w io.Writer) error {
 		return err
 	}
 	if z != int64(e.Size) {
-		err = fmt.Errorf("invalid number of bytes copied (%d != %d)", z, e.Size)
+		err = fmt.Errorf("invalid number of bytes copied (%d != %d)", z, int64(e.Size))
 	}
 	return err
 }
 
 func FetchFiles(base, pattern string) (<-chan Entry, error) {
+	return FetchFilesFS(nil, base, pattern)
+}
+
+func FetchFilesFS(fsys fs.FS, base, pattern string) (<-chan Entry, error) {
+	if fsys == nil {
+		return fetchFiles(base, pattern, false)
+	}
 	if pattern == "" {
-		return walkFiles(base), nil
+		return walkFilesFS(fsys, base), nil
 	}
-	return globFiles(base, pattern)
+	return globFilesFS(fsys, base, pattern)
 }
 
-func walkFiles(base string) <-chan Entry {
+// fetchFiles returns the regular files of base matching pattern. The empty
+// files are only returned when empty is true.
+func fetchFiles(base, pattern string, empty bool) (<-chan Entry, error) {
+	if pattern == "" {
+		return walkFiles(base, empty), nil
+	}
+	return globFiles(base, pattern, empty)
+}
+
+func walkFiles(base string, empty bool) <-chan Entry {
 	queue := make(chan Entry)
 	go func() {
 		defer close(queue)
 		filepath.Walk(base, func(file string, i os.FileInfo, err error) error {
-			if err != nil || !i.Mode().IsRegular() || i.Size() <= 0 {
+			if err != nil || !i.Mode().IsRegular() || (i.Size() <= 0 && !empty) {
 				return nil
 			}
 			queue <- Entry{
 				File: file,
 				Size: float64(i.Size()),
+				info: i,
 			}
 			return nil
 		})
@@ -175,7 +230,7 @@ func walkFiles(base string) <-chan Entry {
 	return queue
 }
 
-func globFiles(base, pattern string) (<-chan Entry, error) {
+func globFiles(base, pattern string, empty bool) (<-chan Entry, error) {
 	g, err := glob.New(pattern, base)
 	if err != nil {
 		return nil, err
@@ -189,13 +244,99 @@ func globFiles(base, pattern string) (<-chan Entry, error) {
 				break
 			}
 			i, err := os.Stat(file)
+			if err == nil && i.Mode().IsRegular() && (i.Size() > 0 || empty) {
+				queue <- Entry{
+					File: file,
+					Size: float64(i.Size()),
+					info: i,
+				}
+			}
+		}
+	}()
+	return queue, nil
+}
+
+func walkFilesFS(fsys fs.FS, base string) <-chan Entry {
+	queue := make(chan Entry)
+	go func() {
+		defer close(queue)
+		fs.WalkDir(fsys, base, func(file string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			i, err := d.Info()
+			if err != nil || i.Size() <= 0 {
+				return nil
+			}
+			queue <- Entry{
+				File: file,
+				Size: float64(i.Size()),
+				fsys: fsys,
+				info: i,
+			}
+			return nil
+		})
+	}()
+	return queue
+}
+
+func globFilesFS(fsys fs.FS, base, pattern string) (<-chan Entry, error) {
+	files, err := fs.Glob(fsys, path.Join(base, pattern))
+	if err != nil {
+		return nil, err
+	}
+	queue := make(chan Entry)
+	go func() {
+		defer close(queue)
+		for _, file := range files {
+			i, err := fs.Stat(fsys, file)
 			if err == nil && i.Mode().IsRegular() && i.Size() > 0 {
 				queue <- Entry{
 					File: file,
 					Size: float64(i.Size()),
+					fsys: fsys,
+					info: i,
 				}
 			}
 		}
 	}()
 	return queue, nil
 }
+
+func openFile(fsys fs.FS, file string) (fs.File, error) {
+	if fsys == nil {
+		return os.Open(file)
+	}
+	return fsys.Open(file)
+}
+
+func statFile(fsys fs.FS, file string) (fs.FileInfo, error) {
+	if fsys == nil {
+		return os.Stat(file)
+	}
+	return fs.Stat(fsys, file)
+}
+
+func cleanPath(fsys fs.FS, file string) string {
+	if fsys == nil {
+		return filepath.Clean(file)
+	}
+	return path.Clean(file)
+}
+
+func joinPath(fsys fs.FS, dir, file string) string {
+	if fsys == nil {
+		return filepath.Join(dir, file)
+	}
+	return path.Join(dir, file)
+}
+
+func relativePath(fsys fs.FS, file, base string) string {
+	if base != "." {
+		return strings.TrimPrefix(file, base)
+	}
+	if fsys != nil {
+		return "/" + file
+	}
+	return string(filepath.Separator) + strings.TrimPrefix(file, "."+string(filepath.Separator))
+}
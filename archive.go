@@ -0,0 +1,468 @@
+package achile
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ArchiveFS interface {
+	fs.FS
+	io.Closer
+}
+
+func IsArchive(file string) bool {
+	if archiveType(file) == "" {
+		return false
+	}
+	i, err := os.Stat(file)
+	return err == nil && i.Mode().IsRegular()
+}
+
+func OpenArchive(file string) (ArchiveFS, error) {
+	var (
+		a   ArchiveFS
+		err error
+	)
+	switch archiveType(file) {
+	case ".zip":
+		var z *zip.ReadCloser
+		if z, err = zip.OpenReader(file); err == nil {
+			a = z
+		}
+	case ".tar":
+		var t *tarFS
+		if t, err = openTar(file, false); err == nil {
+			a = t
+		}
+	case ".tar.gz", ".tgz":
+		var t *tarFS
+		if t, err = openTar(file, true); err == nil {
+			a = t
+		}
+	default:
+		err = fmt.Errorf("%s: unsupported archive format", file)
+	}
+	return a, err
+}
+
+func archiveType(file string) string {
+	file = strings.ToLower(file)
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(file, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// tarFS gives access to the members of a tar archive without extracting it.
+// The files are walked in the same order as the files of the extracted
+// directory, whatever the order of the members in the archive, so that both
+// give the same global checksum.
+//
+// The content of the members of a plain tar archive is read at the offsets
+// found when the archive is opened. A compressed archive can only be read
+// forward: when its members are not stored in the order in which they are
+// walked, it is decompressed once in a temporary file instead of being read
+// again from its beginning each time a member has already been passed.
+type tarFS struct {
+	file  string
+	gzip  bool
+	files map[string]*tarEntry
+
+	// data holds the uncompressed archive when the members are read at
+	// their offset.
+	data  *os.File
+	spool bool
+
+	closer io.Closer
+	reader *tar.Reader
+	pos    int
+}
+
+type tarEntry struct {
+	name   string
+	link   string
+	pos    int
+	offset int64
+	size   int64
+	mode   fs.FileMode
+	mtime  time.Time
+	list   []fs.DirEntry
+}
+
+func openTar(file string, gz bool) (*tarFS, error) {
+	t := tarFS{
+		file: file,
+		gzip: gz,
+		files: map[string]*tarEntry{
+			".": {name: ".", mode: fs.ModeDir | 0755},
+		},
+	}
+	err := t.readHeaders()
+	switch {
+	case err != nil:
+	case !gz:
+		t.closeReader()
+		t.data, err = os.Open(file)
+	case !t.ordered():
+		err = t.decompress()
+	default:
+		err = t.rewind()
+	}
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (t *tarFS) readHeaders() error {
+	cr, err := t.open()
+	if err != nil {
+		return err
+	}
+	for {
+		h, err := t.reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		t.pos++
+		name := path.Clean(strings.TrimPrefix(h.Name, "/"))
+		if name == "." || !fs.ValidPath(name) {
+			continue
+		}
+		e := tarEntry{
+			name:   name,
+			pos:    t.pos,
+			offset: cr.n,
+			size:   h.Size,
+			mode:   h.FileInfo().Mode(),
+			mtime:  h.ModTime,
+		}
+		switch h.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+		case tar.TypeDir:
+		case tar.TypeLink:
+			e.link = path.Clean(strings.TrimPrefix(h.Linkname, "/"))
+			e.mode = fs.FileMode(h.Mode).Perm()
+		default:
+			e.mode |= fs.ModeIrregular
+		}
+		t.insert(&e)
+	}
+	for _, e := range t.files {
+		if e.link == "" {
+			continue
+		}
+		if o, ok := t.files[e.link]; ok && o.mode.IsRegular() {
+			e.size = o.size
+		} else {
+			e.mode |= fs.ModeIrregular
+		}
+	}
+	for _, e := range t.files {
+		sort.Slice(e.list, func(i, j int) bool { return e.list[i].Name() < e.list[j].Name() })
+	}
+	return nil
+}
+
+var errUnordered = errors.New("members not in walk order")
+
+// ordered reports whether the content of the files of the archive is read in
+// a single pass when they are walked.
+func (t *tarFS) ordered() bool {
+	var pos int
+	err := fs.WalkDir(t, ".", func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		e := t.content(t.files[file])
+		if e == nil {
+			return nil
+		}
+		if e.pos <= pos {
+			return errUnordered
+		}
+		pos = e.pos
+		return nil
+	})
+	return err == nil
+}
+
+// decompress writes the uncompressed archive in a temporary file from which
+// the content of the members is read at their offset.
+func (t *tarFS) decompress() error {
+	f, err := ioutil.TempFile("", "achile-*.tar")
+	if err != nil {
+		return err
+	}
+	t.data, t.spool = f, true
+
+	r, err := os.Open(t.file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	_, err = io.Copy(f, z)
+	return err
+}
+
+// content returns the entry holding the content of e.
+func (t *tarFS) content(e *tarEntry) *tarEntry {
+	if e == nil || e.link == "" {
+		return e
+	}
+	return t.files[e.link]
+}
+
+func (t *tarFS) Open(name string) (fs.File, error) {
+	e, err := t.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if e.mode.IsDir() {
+		return &tarDir{tarEntry: e}, nil
+	}
+	if e.link != "" {
+		if e, err = t.lookup("open", e.link); err != nil {
+			return nil, err
+		}
+	}
+	if !e.mode.IsRegular() {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if t.data != nil {
+		f := tarFile{
+			tarEntry: e,
+			Reader:   io.NewSectionReader(t.data, e.offset, e.size),
+		}
+		return &f, nil
+	}
+	if err := t.seek(e.pos); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f := tarFile{
+		tarEntry: e,
+		Reader:   t.reader,
+	}
+	return &f, nil
+}
+
+func (t *tarFS) Stat(name string) (fs.FileInfo, error) {
+	e, err := t.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (t *tarFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	e, err := t.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !e.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	list := make([]fs.DirEntry, len(e.list))
+	copy(list, e.list)
+	return list, nil
+}
+
+func (t *tarFS) Close() error {
+	err := t.closeReader()
+	if t.data != nil {
+		if e := t.data.Close(); e != nil && err == nil {
+			err = e
+		}
+		if t.spool {
+			os.Remove(t.data.Name())
+		}
+		t.data = nil
+	}
+	return err
+}
+
+func (t *tarFS) closeReader() error {
+	if t.closer == nil {
+		return nil
+	}
+	err := t.closer.Close()
+	t.closer, t.reader = nil, nil
+	return err
+}
+
+func (t *tarFS) lookup(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := t.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (t *tarFS) insert(e *tarEntry) {
+	if o, ok := t.files[e.name]; ok {
+		if o.mode.IsDir() && e.mode.IsDir() {
+			o.mtime = e.mtime
+			return
+		}
+		e.list = o.list
+		*o = *e
+		return
+	}
+	t.files[e.name] = e
+	for child := e; child.name != "."; {
+		dir := path.Dir(child.name)
+		parent, ok := t.files[dir]
+		if !ok {
+			parent = &tarEntry{
+				name: dir,
+				mode: fs.ModeDir | 0755,
+			}
+			t.files[dir] = parent
+		}
+		parent.list = append(parent.list, fs.FileInfoToDirEntry(child))
+		if ok {
+			break
+		}
+		child = parent
+	}
+}
+
+func (t *tarFS) seek(pos int) error {
+	if pos <= t.pos {
+		if err := t.rewind(); err != nil {
+			return err
+		}
+	}
+	for t.pos < pos {
+		if _, err := t.reader.Next(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		t.pos++
+	}
+	return nil
+}
+
+func (t *tarFS) rewind() error {
+	_, err := t.open()
+	return err
+}
+
+// open starts reading the archive from its beginning. The reader returned
+// counts the bytes of the uncompressed archive read to find the offsets of
+// the members.
+func (t *tarFS) open() (*countReader, error) {
+	t.closeReader()
+
+	f, err := os.Open(t.file)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = f
+	t.closer = f
+	if t.gzip {
+		z, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r, t.closer = z, multiCloser{z, f}
+	}
+	cr := countReader{r: r}
+	t.reader = tar.NewReader(&cr)
+	t.pos = 0
+	return &cr, nil
+}
+
+func (e *tarEntry) Name() string       { return path.Base(e.name) }
+func (e *tarEntry) Size() int64        { return e.size }
+func (e *tarEntry) Mode() fs.FileMode  { return e.mode }
+func (e *tarEntry) ModTime() time.Time { return e.mtime }
+func (e *tarEntry) IsDir() bool        { return e.mode.IsDir() }
+func (e *tarEntry) Sys() interface{}   { return nil }
+
+type tarFile struct {
+	*tarEntry
+	io.Reader
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.tarEntry, nil }
+func (f *tarFile) Close() error               { return nil }
+
+type tarDir struct {
+	*tarEntry
+	offset int
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) { return d.tarEntry, nil }
+func (d *tarDir) Close() error               { return nil }
+
+func (d *tarDir) Read(_ []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: errors.New("is a directory")}
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.list[d.offset:]
+	if n <= 0 {
+		d.offset += len(rest)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(bs []byte) (int, error) {
+	n, err := c.r.Read(bs)
+	c.n += int64(n)
+	return n, err
+}
+
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if e := c.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package achile
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarChecksum(t *testing.T) {
+	var (
+		tmp  = t.TempDir()
+		dir  = filepath.Join(tmp, "dir")
+		data = map[string]string{
+			"a":     "content of a",
+			"b":     "content of b",
+			"c":     "content of c",
+			"d.txt": "content of d.txt",
+			"d/x":   "content of d/x",
+			"d/y/z": "content of d/y/z",
+		}
+	)
+	for name, content := range data {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, wz := scanChecksum(t, nil, dir)
+
+	archives := []struct {
+		Name    string
+		Members []string
+		Spool   bool
+	}{
+		{Name: "ordered.tar", Members: []string{"a", "b", "c", "d/x", "d/y/z", "d.txt"}},
+		{Name: "unordered.tar", Members: []string{"b", "d.txt", "a", "d/y/z", "c", "d/x"}},
+		{Name: "ordered.tar.gz", Members: []string{"a", "b", "c", "d/x", "d/y/z", "d.txt"}},
+		{Name: "unordered.tar.gz", Members: []string{"b", "d.txt", "a", "d/y/z", "c", "d/x"}, Spool: true},
+	}
+	for _, a := range archives {
+		file := filepath.Join(tmp, a.Name)
+		writeTar(t, file, a.Members, data)
+
+		fsys, err := OpenArchive(file)
+		if err != nil {
+			t.Fatalf("%s: %s", a.Name, err)
+		}
+		if spool := fsys.(*tarFS).spool; spool != a.Spool {
+			t.Errorf("%s: archive decompressed: %t, want %t", a.Name, spool, a.Spool)
+		}
+		got, gz := scanChecksum(t, fsys, ".")
+		if !bytes.Equal(got, want) || !gz.Equal(wz) {
+			t.Errorf("%s: checksum %x (%d files), want %x (%d files)", a.Name, got, gz.Count, want, wz.Count)
+		}
+		spool := fsys.(*tarFS).data
+		if err := fsys.Close(); err != nil {
+			t.Errorf("%s: close: %s", a.Name, err)
+		}
+		if spool != nil && a.Spool {
+			if _, err := os.Stat(spool.Name()); !os.IsNotExist(err) {
+				t.Errorf("%s: temporary file not removed", a.Name)
+			}
+		}
+	}
+}
+
+func scanChecksum(t *testing.T, fsys ArchiveFS, base string, opts ...Option) ([]byte, Coze) {
+	t.Helper()
+	if fsys != nil {
+		opts = append(opts, WithFS(fsys))
+	}
+	s, err := NewScanner("sha256", "", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cz, err := s.Scan(base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Checksum(), cz
+}
+
+func writeTar(t *testing.T, file string, members []string, data map[string]string) {
+	t.Helper()
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	if filepath.Ext(file) == ".gz" {
+		z := gzip.NewWriter(f)
+		defer z.Close()
+		w = z
+	}
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	for _, m := range members {
+		h := tar.Header{
+			Name:     m,
+			Mode:     0644,
+			Size:     int64(len(data[m])),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, data[m]); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package achile
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	authMethod = "hmac-sha256"
+	nonceLen   = 32
+)
+
+var ErrDenied = errors.New("access denied")
+
+func WithCredentials(user, token string) ClientOption {
+	return func(c *Client) {
+		c.user, c.token = user, token
+	}
+}
+
+func WithUsers(users map[string]string) HandlerOption {
+	return func(h *Handler) {
+		h.users = users
+	}
+}
+
+func computeMac(token string, nonce []byte, user string) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write(nonce)
+	mac.Write([]byte(user))
+	return mac.Sum(nil)
+}
+
+func (c *Client) authenticate(params map[string]string) error {
+	method, ok := params["auth"]
+	if !ok {
+		return nil
+	}
+	if method != authMethod {
+		return fmt.Errorf("%w: unsupported authentication method %s", ErrDenied, method)
+	}
+	if c.token == "" {
+		return fmt.Errorf("%w: server requires authentication", ErrDenied)
+	}
+	nonce, err := hex.DecodeString(params["challenge"])
+	if err != nil || len(nonce) != nonceLen {
+		return fmt.Errorf("%w: invalid challenge", ErrDenied)
+	}
+	raw := []byte(c.user)
+	return c.roundTrip(ReqAuth, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		w.Write(raw)
+		_, err := w.Write(computeMac(c.token, nonce, c.user))
+		return err
+	})
+}
+
+func (h *Handler) challenge(params map[string]string) error {
+	if len(h.users) == 0 {
+		h.authed = true
+		return nil
+	}
+	h.nonce = make([]byte, nonceLen)
+	if _, err := rand.Read(h.nonce); err != nil {
+		return err
+	}
+	params["auth"] = authMethod
+	params["challenge"] = hex.EncodeToString(h.nonce)
+	return nil
+}
+
+func (h *Handler) handleAuth(rs io.Reader) *Result {
+	var z uint16
+	if err := binary.Read(rs, binary.BigEndian, &z); err != nil {
+		return unhandledResult(err)
+	}
+	user := make([]byte, z)
+	if _, err := io.ReadFull(rs, user); err != nil {
+		return unhandledResult(err)
+	}
+	sum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(rs, sum); err != nil {
+		return unhandledResult(err)
+	}
+	token, ok := h.users[string(user)]
+	if !ok || h.nonce == nil || !hmac.Equal(sum, computeMac(token, h.nonce, string(user))) {
+		return deniedResult(fmt.Errorf("invalid credentials"))
+	}
+	h.authed, h.user, h.nonce = true, string(user), nil
+	return emptyResult()
+}
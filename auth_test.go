@@ -0,0 +1,42 @@
+package achile
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	users := map[string]string{
+		"":      "anonymous-token",
+		"alice": "alice-token",
+	}
+	addr := serve(t, t.TempDir(), nil, WithUsers(users))
+
+	data := []struct {
+		Name  string
+		User  string
+		Token string
+		Ok    bool
+	}{
+		{Name: "valid token", User: "alice", Token: "alice-token", Ok: true},
+		{Name: "valid token without user", Token: "anonymous-token", Ok: true},
+		{Name: "bad token", User: "alice", Token: "bob-token"},
+		{Name: "token of another user", User: "alice", Token: "anonymous-token"},
+		{Name: "unknown user", User: "bob", Token: "alice-token"},
+		{Name: "no token"},
+	}
+	for _, d := range data {
+		c, err := NewClient(addr, "sha256", WithCredentials(d.User, d.Token))
+		if err == nil {
+			c.Close()
+		}
+		switch {
+		case d.Ok && err != nil:
+			t.Errorf("%s: unexpected error: %s", d.Name, err)
+		case !d.Ok && err == nil:
+			t.Errorf("%s: client accepted", d.Name)
+		case !d.Ok && !errors.Is(err, ErrDenied):
+			t.Errorf("%s: unexpected error: %s", d.Name, err)
+		}
+	}
+}
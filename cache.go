@@ -0,0 +1,130 @@
+package achile
+
+import (
+	"encoding/gob"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Cache keeps the digests of the files hashed during a previous scan. A file
+// is only read again when its size, modification time, inode or change time
+// differ from the ones it had when it was hashed. Since the global checksum
+// of a scan is computed from the digests of its files, a change to one file
+// does not prevent the others to be found in the cache.
+type Cache struct {
+	file     string
+	alg      string
+	maxAge   time.Duration
+	paranoid bool
+
+	prev map[string]cacheEntry
+	next map[string]cacheEntry
+}
+
+type cacheKey struct {
+	Size  int64
+	Mtime int64
+	Inode uint64
+	Ctime int64
+}
+
+type cacheEntry struct {
+	Key   cacheKey
+	Time  int64
+	Local []byte
+}
+
+type cacheFile struct {
+	Alg     string
+	Entries map[string]cacheEntry
+}
+
+func NewCache(file, alg string, maxAge time.Duration, paranoid bool) (*Cache, error) {
+	c := Cache{
+		file:     file,
+		alg:      strings.ToLower(alg),
+		maxAge:   maxAge,
+		paranoid: paranoid,
+		prev:     make(map[string]cacheEntry),
+		next:     make(map[string]cacheEntry),
+	}
+	r, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var cf cacheFile
+	if err := gob.NewDecoder(r).Decode(&cf); err != nil {
+		return &c, nil
+	}
+	if cf.Alg == c.alg && cf.Entries != nil {
+		c.prev = cf.Entries
+	}
+	return &c, nil
+}
+
+func (c *Cache) Save(complete bool) error {
+	entries := c.next
+	if !complete {
+		for k, e := range c.prev {
+			if _, ok := entries[k]; !ok {
+				entries[k] = e
+			}
+		}
+	}
+	w, err := os.CreateTemp(filepath.Dir(c.file), "."+filepath.Base(c.file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(w.Name())
+
+	cf := cacheFile{
+		Alg:     c.alg,
+		Entries: entries,
+	}
+	if err := gob.NewEncoder(w).Encode(cf); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.Name(), c.file)
+}
+
+func (c *Cache) lookup(file string, key cacheKey) ([]byte, bool) {
+	e, ok := c.prev[file]
+	if !ok || c.paranoid || e.Key != key {
+		return nil, false
+	}
+	if c.maxAge > 0 && time.Since(time.Unix(0, e.Time)) > c.maxAge {
+		return nil, false
+	}
+	c.next[file] = e
+	return e.Local, true
+}
+
+func (c *Cache) store(file string, key cacheKey, local []byte) {
+	c.next[file] = cacheEntry{
+		Key:   key,
+		Time:  time.Now().UnixNano(),
+		Local: local,
+	}
+}
+
+func cacheKeyOf(i fs.FileInfo) cacheKey {
+	k := cacheKey{
+		Size:  i.Size(),
+		Mtime: i.ModTime().UnixNano(),
+	}
+	k.Inode, k.Ctime = statInode(i)
+	return k
+}
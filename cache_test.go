@@ -0,0 +1,54 @@
+package achile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCacheRescan(t *testing.T) {
+	var (
+		tmp   = t.TempDir()
+		dir   = filepath.Join(tmp, "dir")
+		file  = filepath.Join(tmp, "cache")
+		names = []string{"a", "b", "c", "d", "e"}
+	)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range names {
+		if err := os.WriteFile(filepath.Join(dir, n), []byte("content of "+n), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan := func() *Cache {
+		c, err := NewCache(file, "sha256", 0, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := scanChecksum(t, nil, dir, WithCache(c))
+		if want, _ := scanChecksum(t, nil, dir); !bytes.Equal(got, want) {
+			t.Errorf("checksum with cache %x, want %x", got, want)
+		}
+		if err := c.Save(true); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	scan()
+	if err := os.WriteFile(filepath.Join(dir, "b"), []byte("modified content of b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := scan()
+	for _, n := range names {
+		f, err := filepath.Abs(filepath.Join(dir, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		prev, next := c.prev[f], c.next[f]
+		if hit := prev.Time == next.Time; hit != (n != "b") {
+			t.Errorf("%s: found in cache: %t", n, hit)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"io"
+	"os"
 	"strings"
 	"time"
 
@@ -15,6 +17,7 @@ func runCompare(cmd *cli.Command, args []string) error {
 		// abort    = cmd.Flag.Bool("e", false, "")
 		verbose  = cmd.Flag.Bool("v", false, "verbose")
 		fullstat = cmd.Flag.Bool("s", false, "show full stats")
+		progress = cmd.Flag.Bool("progress", false, "show progress")
 	)
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
@@ -27,6 +30,16 @@ func runCompare(cmd *cli.Command, args []string) error {
 		achile.WithPretty(*pretty),
 		achile.WithVerbose(*verbose),
 	}
+	var prog *achile.Progress
+	if *progress && !*list {
+		p, err := startListProgress(cmd.Flag.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer p.Stop()
+		options = append(options, achile.WithProgress(p))
+		prog = p
+	}
 	cmp, err := achile.NewComparer(cmd.Flag.Arg(0), options...)
 	if err != nil {
 		return err
@@ -42,6 +55,9 @@ func runCompare(cmd *cli.Command, args []string) error {
 	} else {
 		cz, err = cmp.Compare(dirs)
 	}
+	if prog != nil {
+		prog.Stop()
+	}
 	if elapsed, dir := time.Since(now), strings.Join(dirs, ", "); *fullstat {
 		Full(cmp, cz, dir, elapsed, *pretty)
 	} else {
@@ -49,3 +65,56 @@ func runCompare(cmd *cli.Command, args []string) error {
 	}
 	return err
 }
+
+func runDiff(cmd *cli.Command, args []string) error {
+	var (
+		pattern = cmd.Flag.String("p", "", "pattern")
+		algo    = cmd.Flag.String("a", "", "algorithm")
+		dir     = cmd.Flag.String("d", "", "remote directory")
+		list    = cmd.Flag.String("w", "", "file")
+		pretty  = cmd.Flag.Bool("y", false, "pretty size")
+		remote  = registerRemote(cmd)
+	)
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	copts, err := remote.Options()
+	if err != nil {
+		return err
+	}
+	client, err := achile.NewClient(cmd.Flag.Arg(0), *algo, copts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	var w *os.File
+	if *list != "" {
+		w, err = os.Create(*list)
+	} else {
+		w, err = os.CreateTemp("", "achile-*.lst")
+		if err == nil {
+			defer os.Remove(w.Name())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	now := time.Now()
+	if err := client.Scan(*dir, *pattern, w); err != nil {
+		return err
+	}
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cmp, err := achile.NewComparerReader(w, achile.WithVerbose(true), achile.WithPretty(*pretty))
+	if err != nil {
+		return err
+	}
+	dirs := cmd.Flag.Args()[1:]
+	cz, err := cmp.Diff(dirs, *pattern)
+	Short(cmp, cz, strings.Join(dirs, ", "), time.Since(now), *pretty)
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// limiter bounds the number of clients served at once, in total and per
+// remote address.
+type limiter struct {
+	max   int
+	perIP int
+
+	mu    sync.Mutex
+	count int
+	hosts map[string]int
+}
+
+func newLimiter(max, perIP int) *limiter {
+	return &limiter{
+		max:   max,
+		perIP: perIP,
+		hosts: make(map[string]int),
+	}
+}
+
+// set changes the limits, the clients already served are kept even when they
+// are over the new limits.
+func (l *limiter) set(max, perIP int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max, l.perIP = max, perIP
+}
+
+func (l *limiter) acquire(c net.Conn) (string, error) {
+	host := c.RemoteAddr().String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.count >= l.max {
+		return host, fmt.Errorf("too many clients (%d)", l.max)
+	}
+	if l.perIP > 0 && l.hosts[host] >= l.perIP {
+		return host, fmt.Errorf("too many clients from %s (%d)", host, l.perIP)
+	}
+	l.count++
+	l.hosts[host]++
+	return host, nil
+}
+
+func (l *limiter) release(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.count--
+	if l.hosts[host]--; l.hosts[host] <= 0 {
+		delete(l.hosts, host)
+	}
+}
@@ -1,70 +1,278 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"fmt"
+	"io/fs"
 	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/busoc/achile"
 	"github.com/busoc/cli"
 	"github.com/busoc/toml"
 )
 
+type listenConfig struct {
+	Addr    string
+	Base    string
+	Clients uint16 `toml:"client"`
+	Umask   string
+	Owner   string
+	Partial string
+	Trash   string
+	Workers int
+	Token   string
+	Users   []struct {
+		Name  string
+		Token string
+	} `toml:"user"`
+	Cert struct {
+		Pem  string
+		Key  string
+		Root string
+	} `toml:"certificate"`
+
+	Preserve string
+	PerIP    uint16 `toml:"client_per_ip"`
+	Idle     string
+	Duration string
+	Shutdown string
+	Mode     string
+	Shares   []struct {
+		Name       string
+		Path       string
+		Mode       string
+		Algorithms []string
+		Token      string
+		Users      []string
+	} `toml:"share"`
+}
+
+func loadListen(file string) (*listenConfig, error) {
+	var cfg listenConfig
+	if err := toml.DecodeFile(file, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
 func runListen(cmd *cli.Command, args []string) error {
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
-	cfg := struct {
-		Addr    string
-		Base    string
-		Clients uint16 `toml:"client"`
-		Cert    struct {
-			Pem  string
-			Key  string
-			Root string
-		} `toml:"certificate"`
-	}{}
-	if err := toml.DecodeFile(cmd.Flag.Arg(0), &cfg); err != nil {
+	srv, err := newServer(cmd.Flag.Arg(0))
+	if err != nil {
 		return err
 	}
-	s, err := net.Listen("tcp", cfg.Addr)
+	s, err := net.Listen("tcp", srv.addr)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	if cfg.Cert.Pem != "" {
-		cert, err := tls.LoadX509KeyPair(cfg.Cert.Pem, cfg.Cert.Key)
+	var (
+		sig   = make(chan os.Signal, 1)
+		done  = make(chan struct{})
+		abort = make(chan struct{})
+	)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sig)
+	go func() {
+		var stopping bool
+		for x := range sig {
+			switch {
+			case x == syscall.SIGHUP:
+				if err := srv.reload(); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: configuration not reloaded: %s\n", cmd.Flag.Arg(0), err)
+				}
+			case !stopping:
+				stopping = true
+				close(done)
+				s.Close()
+			default:
+				close(abort)
+				return
+			}
+		}
+	}()
+	for {
+		c, err := s.Accept()
 		if err != nil {
-			return err
+			select {
+			case <-done:
+				return srv.shutdown(abort)
+			default:
+				return err
+			}
+		}
+		srv.serve(c)
+	}
+}
+
+func (cfg *listenConfig) options() ([]achile.HandlerOption, error) {
+	options, err := handlerOptions(cfg.Umask, cfg.Owner)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	if cfg.Token != "" {
+		users[""] = cfg.Token
+	}
+	for _, u := range cfg.Users {
+		if u.Token != "" {
+			users[u.Name] = u.Token
 		}
-		var root *x509.CertPool
-		if cfg.Cert.Root == "" {
-			root, err = x509.SystemCertPool()
-		} else {
-			root = x509.NewCertPool()
+	}
+	options = append(options, achile.WithUsers(users))
+	if cfg.Mode != "" {
+		m, err := achile.ParseMode(cfg.Mode)
+		if err != nil {
+			return nil, err
 		}
+		options = append(options, achile.WithMode(m))
+	}
+	if len(cfg.Shares) > 0 {
+		shares, err := cfg.shares(users)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		c := tls.Config{
-			Certificates: []tls.Certificate{cert},
-			ClientCAs:    root,
+		options = append(options, achile.WithShares(shares...))
+	}
+	if cfg.Workers > 0 {
+		options = append(options, achile.WithWorkers(cfg.Workers))
+	}
+	if cfg.Idle != "" {
+		d, err := time.ParseDuration(cfg.Idle)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid idle timeout", cfg.Idle)
 		}
-		s = tls.NewListener(s, &c)
+		options = append(options, achile.WithIdleTimeout(d))
 	}
-	defer s.Close()
-	for {
-		c, err := s.Accept()
+	if cfg.Duration != "" {
+		d, err := time.ParseDuration(cfg.Duration)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("%s: invalid session duration", cfg.Duration)
 		}
-		h, err := achile.NewHandler(c, cfg.Base)
-		if err == nil {
-			go h.Handle()
-		} else {
-			c.Close()
+		options = append(options, achile.WithSessionTimeout(d))
+	}
+	if cfg.Preserve != "" {
+		p, err := achile.ParsePreserve(cfg.Preserve)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, achile.WithPreserve(p))
+	}
+	if cfg.Trash != "" {
+		if err := os.MkdirAll(cfg.Trash, 0755); err != nil {
+			return nil, err
+		}
+		options = append(options, achile.WithTrash(cfg.Trash))
+	}
+	return options, nil
+}
+
+func (cfg *listenConfig) shares(users map[string]string) ([]achile.Share, error) {
+	var (
+		list = make([]achile.Share, 0, len(cfg.Shares))
+		seen = make(map[string]struct{})
+	)
+	for _, s := range cfg.Shares {
+		if s.Name == "" || s.Path == "" || strings.IndexByte(s.Name, '/') >= 0 {
+			return nil, fmt.Errorf("share %q: invalid name or path", s.Name)
+		}
+		if _, ok := seen[s.Name]; ok {
+			return nil, fmt.Errorf("share %s: defined more than once", s.Name)
+		}
+		seen[s.Name] = struct{}{}
+		for _, a := range s.Algorithms {
+			if _, err := achile.SizeHash(a); err != nil {
+				return nil, fmt.Errorf("share %s: %w", s.Name, err)
+			}
+		}
+		mode, err := achile.ParseMode(s.Mode)
+		if err != nil {
+			return nil, fmt.Errorf("share %s: %w", s.Name, err)
+		}
+		share := achile.Share{
+			Name: s.Name,
+			Base: s.Path,
+			Mode: mode,
+			Algs: s.Algorithms,
+		}
+		if s.Token != "" || len(s.Users) > 0 {
+			share.Users = make(map[string]string)
+			if s.Token != "" {
+				share.Users[""] = s.Token
+			}
+			for _, u := range s.Users {
+				token, ok := users[u]
+				if !ok || u == "" {
+					return nil, fmt.Errorf("share %s: unknown user %q", s.Name, u)
+				}
+				share.Users[u] = token
+			}
+		}
+		list = append(list, share)
+	}
+	return list, nil
+}
+
+func handlerOptions(umask, owner string) ([]achile.HandlerOption, error) {
+	var options []achile.HandlerOption
+	if umask != "" {
+		m, err := strconv.ParseUint(umask, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid umask", umask)
+		}
+		options = append(options, achile.WithUmask(fs.FileMode(m)))
+	}
+	if owner != "" {
+		uid, gid, err := lookupOwner(owner)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, achile.WithOwner(uid, gid))
+	}
+	return options, nil
+}
+
+func lookupOwner(owner string) (int, int, error) {
+	var (
+		name, group = owner, ""
+		uid, gid    = -1, -1
+	)
+	if x := strings.IndexByte(owner, ':'); x >= 0 {
+		name, group = owner[:x], owner[x+1:]
+	}
+	if name != "" {
+		id := name
+		if _, err := strconv.Atoi(name); err != nil {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return uid, gid, err
+			}
+			id = u.Uid
+			if group == "" {
+				group = u.Gid
+			}
+		}
+		uid, _ = strconv.Atoi(id)
+	}
+	if group != "" {
+		id := group
+		if _, err := strconv.Atoi(group); err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return uid, gid, err
+			}
+			id = g.Gid
 		}
+		gid, _ = strconv.Atoi(id)
 	}
-	return nil
+	return uid, gid, nil
 }
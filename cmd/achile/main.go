@@ -33,27 +33,38 @@ Use {{.Name}} [command] -h for more information about its usage.
 func main() {
 	commands := []*cli.Command{
 		{
-			Usage: "scan [-a algorithm] [-p pattern] [-w file] [-v verbose] [-y pretty] [-m intermediate stats] [-s full stats] [-x allow empty folder(s)] <directory>",
-			Short: "hash files found in a given directory",
+			Usage: "scan [-a algorithm] [-p pattern] [-w file] [-v verbose] [-y pretty] [-m intermediate stats] [-s full stats] [-x allow empty folder(s)] [-c cache] [-paranoid] [-max-age duration] [-resume] [-progress] <directory|archive...>",
+			Short: "hash files found in a given directory or archive",
 			Alias: []string{"walk"},
 			Run:   runScan,
 		},
 		{
-			Usage: "compare [-v] <list> <directory...>",
+			Usage: "compare [-v] [-progress] <list> <directory|archive...>",
 			Short: "compare files from a list of known hashes",
 			Alias: []string{"cmp"},
 			Run:   runCompare,
 		},
 		{
-			Usage: "check [-a algorithm] [-p pattern] [-t transfer] <host:port> <directory>",
+			Usage: "diff [-a algorithm] [-p pattern] [-d directory] [-w file] [-y pretty] [-tls] [-ca file] [-cert file] [-key file] [-server-name name] [-user name] [-token token] [-timeout duration] <host:port[/share]> <directory...>",
+			Short: "compare local files with the files found by a remote server",
+			Run:   runDiff,
+		},
+		{
+			Usage: "check [-a algorithm] [-p pattern] [-t transfer] [-delete] [-dry-run] [-max-delete n] [-progress] [-tls] [-ca file] [-cert file] [-key file] [-server-name name] [-user name] [-token token] [-compress method] [-compress-skip ext,...] [-pipeline n] [-c connections] [-timeout duration] [-preserve] <host:port[/share]> <directory>",
 			Short: "check and compare local files with files on a remote server",
 			Run:   runCheck,
 		},
 		{
-			Usage: "transfer [-a algorithm] [-p pattern] <host:port> <directory...>",
+			Usage: "transfer [-a algorithm] [-p pattern] [-dry-run] [-progress] [-tls] [-ca file] [-cert file] [-key file] [-server-name name] [-user name] [-token token] [-compress method] [-compress-skip ext,...] [-pipeline n] [-c connections] [-timeout duration] [-preserve] <host:port[/share]> <directory...>",
 			Short: "copy local files in given directory to a remote server",
 			Run:   runTransfer,
 		},
+		{
+			Usage: "fetch [-a algorithm] [-p pattern] [-v] [-tls] [-ca file] [-cert file] [-key file] [-server-name name] [-user name] [-token token] [-timeout duration] <host:port[/share]> <directory>",
+			Short: "download files from a remote server to a local directory",
+			Alias: []string{"pull"},
+			Run:   runFetch,
+		},
 		{
 			Usage: "listen <config>",
 			Short: "run a server to verify or copy files from one server to another",
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 	"time"
 
@@ -47,3 +48,23 @@ func Short(ac Checksumer, cz achile.Coze, base string, elapsed time.Duration, pr
 		fmt.Printf("%s(%s): %d - %d files %x\n", base, elapsed, int64(cz.Size), cz.Count, sum)
 	}
 }
+
+func startProgress(dirs []string, pattern string) (*achile.Progress, error) {
+	p := achile.NewProgress(os.Stderr)
+	for _, d := range dirs {
+		if err := p.Count(d, pattern); err != nil {
+			return nil, err
+		}
+	}
+	p.Start()
+	return p, nil
+}
+
+func startListProgress(list string) (*achile.Progress, error) {
+	p := achile.NewProgress(os.Stderr)
+	if err := p.CountList(list); err != nil {
+		return nil, err
+	}
+	p.Start()
+	return p, nil
+}
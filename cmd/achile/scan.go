@@ -1,13 +1,14 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/busoc/achile"
 	"github.com/busoc/cli"
 )
 
-func runScan(cmd *cli.Command, args []string) error {
+func runScan(cmd *cli.Command, args []string) (err error) {
 	var (
 		pattern  = cmd.Flag.String("p", "", "pattern")
 		algo     = cmd.Flag.String("a", "", "algorithm")
@@ -17,6 +18,11 @@ func runScan(cmd *cli.Command, args []string) error {
 		fullstat = cmd.Flag.Bool("s", false, "show full stat")
 		middle   = cmd.Flag.Bool("m", false, "show intermediary results")
 		zeros    = cmd.Flag.Bool("z", false, "keep results from empty directory")
+		file     = cmd.Flag.String("c", "", "cache")
+		paranoid = cmd.Flag.Bool("paranoid", false, "ignore digests found in cache")
+		maxAge   = cmd.Flag.Duration("max-age", 0, "maximum age of digests found in cache")
+		resume   = cmd.Flag.Bool("resume", false, "resume an interrupted scan")
+		progress = cmd.Flag.Bool("progress", false, "show progress")
 	)
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
@@ -25,7 +31,32 @@ func runScan(cmd *cli.Command, args []string) error {
 		achile.WithVerbose(*verbose),
 		achile.WithPretty(*pretty),
 	}
-	scan, err := achile.NewScanner(*algo, *list, options...)
+	if *file != "" {
+		var cache *achile.Cache
+		if cache, err = achile.NewCache(*file, *algo, *maxAge, *paranoid); err != nil {
+			return err
+		}
+		options = append(options, achile.WithCache(cache))
+		defer func() {
+			if e := cache.Save(err == nil); e != nil && err == nil {
+				err = fmt.Errorf("%s: cache not saved: %w", *file, e)
+			}
+		}()
+	}
+	var prog *achile.Progress
+	if *progress {
+		if prog, err = startProgress(cmd.Flag.Args(), *pattern); err != nil {
+			return err
+		}
+		defer prog.Stop()
+		options = append(options, achile.WithProgress(prog))
+	}
+	var scan *achile.Scanner
+	if *resume {
+		scan, err = achile.ResumeScanner(*algo, *list, options...)
+	} else {
+		scan, err = achile.NewScanner(*algo, *list, options...)
+	}
 	if err != nil {
 		return err
 	}
@@ -37,8 +68,8 @@ func runScan(cmd *cli.Command, args []string) error {
 	)
 	for _, a := range cmd.Flag.Args() {
 		now := time.Now()
-		cz, err := scan.Scan(a, *pattern)
-		if err != nil {
+		var cz achile.Coze
+		if cz, err = scan.Scan(a, *pattern); err != nil {
 			return err
 		}
 		if !*zeros && cz.Count == 0 {
@@ -53,6 +84,9 @@ func runScan(cmd *cli.Command, args []string) error {
 		}
 		all = all.Merge(cz)
 	}
+	if prog != nil {
+		prog.Stop()
+	}
 	if cmd.Flag.NArg() > 1 {
 		if elapsed := time.Since(begin); *fullstat {
 			Full(scan, all, "", elapsed, *pretty)
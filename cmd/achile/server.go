@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/busoc/achile"
+)
+
+const defaultGrace = time.Minute
+
+// server holds the settings of the listen command that can be reloaded while
+// it runs and keeps track of the connections of the clients being served.
+type server struct {
+	file string
+	addr string
+
+	mu      sync.Mutex
+	base    string
+	options []achile.HandlerOption
+	tls     *tls.Config
+	grace   time.Duration
+	limit   *limiter
+
+	conns    map[net.Conn]*achile.Handler
+	stopping bool
+	wg       sync.WaitGroup
+
+	// directories whose temporary files have already been removed. They
+	// are not cleaned up again on reload since the transfers in progress
+	// write their temporary files there.
+	cleaned map[string]struct{}
+}
+
+func newServer(file string) (*server, error) {
+	cfg, err := loadListen(file)
+	if err != nil {
+		return nil, err
+	}
+	s := server{
+		file:    file,
+		addr:    cfg.Addr,
+		limit:   newLimiter(0, 0),
+		conns:   make(map[net.Conn]*achile.Handler),
+		cleaned: make(map[string]struct{}),
+	}
+	return &s, s.configure(cfg)
+}
+
+// reload reads the configuration file again. The clients already connected
+// keep the settings they had when they were accepted.
+func (s *server) reload() error {
+	cfg, err := loadListen(s.file)
+	if err != nil {
+		return err
+	}
+	if cfg.Addr != s.addr {
+		fmt.Fprintf(os.Stderr, "%s: address can not be changed without restarting (still listening on %s)\n", cfg.Addr, s.addr)
+	}
+	return s.configure(cfg)
+}
+
+func (s *server) configure(cfg *listenConfig) error {
+	if cfg.Base == "" && len(cfg.Shares) == 0 {
+		return fmt.Errorf("no base directory nor share defined")
+	}
+	keep := 24 * time.Hour
+	if cfg.Partial != "" {
+		d, err := time.ParseDuration(cfg.Partial)
+		if err != nil {
+			return fmt.Errorf("%s: invalid partial retention", cfg.Partial)
+		}
+		keep = d
+	}
+	options, err := cfg.options()
+	if err != nil {
+		return err
+	}
+	mode, _ := achile.ParseMode(cfg.Mode)
+	dirs := map[string]achile.Mode{cfg.Base: mode}
+	for _, sh := range cfg.Shares {
+		m, _ := achile.ParseMode(sh.Mode)
+		if m < mode {
+			m = mode
+		}
+		if prev, ok := dirs[sh.Path]; !ok || m < prev {
+			dirs[sh.Path] = m
+		}
+	}
+	for d, m := range dirs {
+		if d == "" {
+			continue
+		}
+		// the directories that the clients can not modify are neither
+		// created nor cleaned up.
+		if m != achile.ReadWrite {
+			if _, err := os.Stat(d); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+		if _, ok := s.cleaned[d]; ok {
+			continue
+		}
+		if err := achile.CleanTemp(d, keep); err != nil {
+			return err
+		}
+		s.cleaned[d] = struct{}{}
+	}
+	var tc *tls.Config
+	if cfg.Cert.Pem != "" {
+		if tc, err = serverConfig(cfg.Cert.Pem, cfg.Cert.Key, cfg.Cert.Root); err != nil {
+			return err
+		}
+	}
+	grace := defaultGrace
+	if cfg.Shutdown != "" {
+		if grace, err = time.ParseDuration(cfg.Shutdown); err != nil {
+			return fmt.Errorf("%s: invalid shutdown delay", cfg.Shutdown)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.base, s.options, s.tls, s.grace = cfg.Base, options, tc, grace
+	s.limit.set(int(cfg.Clients), int(cfg.PerIP))
+	return nil
+}
+
+func (s *server) serve(c net.Conn) {
+	s.mu.Lock()
+	var (
+		base    = s.base
+		options = s.options
+		conn    = c
+	)
+	if s.tls != nil {
+		conn = tls.Server(c, s.tls)
+	}
+	s.mu.Unlock()
+
+	host, err := s.limit.acquire(c)
+	if err != nil {
+		go achile.Reject(conn, err)
+		return
+	}
+	s.track(c, true)
+	go func() {
+		defer s.track(c, false)
+		defer s.limit.release(host)
+		h, err := achile.NewHandler(conn, base, options...)
+		if err == nil {
+			s.attach(c, h)
+			h.Handle()
+		} else {
+			conn.Close()
+		}
+	}()
+}
+
+func (s *server) track(c net.Conn, active bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if active {
+		s.conns[c] = nil
+		s.wg.Add(1)
+	} else {
+		delete(s.conns, c)
+		s.wg.Done()
+	}
+}
+
+func (s *server) attach(c net.Conn, h *achile.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = h
+	if s.stopping {
+		h.Shutdown()
+	}
+}
+
+// shutdown stops processing the requests of the clients still connected once
+// their current requests are done. The connections still open after the
+// grace delay, or as soon as abort is closed, are closed. The partial files
+// of the transfers interrupted are kept to be resumed.
+func (s *server) shutdown(abort <-chan struct{}) error {
+	s.mu.Lock()
+	s.stopping = true
+	for _, h := range s.conns {
+		if h != nil {
+			h.Shutdown()
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	s.mu.Lock()
+	grace := s.grace
+	s.mu.Unlock()
+
+	t := time.NewTimer(grace)
+	defer t.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-t.C:
+	case <-abort:
+	}
+
+	s.mu.Lock()
+	n := len(s.conns)
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	<-done
+	return fmt.Errorf("%d session(s) aborted", n)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 	"time"
 
 	"github.com/busoc/achile"
@@ -10,20 +11,41 @@ import (
 
 func runTransfer(cmd *cli.Command, args []string) error {
 	var (
-		pattern = cmd.Flag.String("p", "", "pattern")
-		algo    = cmd.Flag.String("a", "", "algorithm")
-		verbose = cmd.Flag.Bool("v", false, "verbose")
+		pattern  = cmd.Flag.String("p", "", "pattern")
+		algo     = cmd.Flag.String("a", "", "algorithm")
+		verbose  = cmd.Flag.Bool("v", false, "verbose")
+		dryRun   = cmd.Flag.Bool("dry-run", false, "only report the files that would be copied")
+		progress = cmd.Flag.Bool("progress", false, "show progress")
+		remote   = registerRemote(cmd)
 	)
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
-	client, err := achile.NewClient(cmd.Flag.Arg(0), *algo)
+	copts, err := remote.Options()
+	if err != nil {
+		return err
+	}
+	client, err := achile.NewClient(cmd.Flag.Arg(0), *algo, copts...)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	scan, err := achile.NewScanner(*algo, "")
+	var options []achile.Option
+	if *progress {
+		p, err := startProgress(cmd.Flag.Args()[1:], *pattern)
+		if err != nil {
+			return err
+		}
+		defer p.Stop()
+		options = append(options, achile.WithProgress(p))
+	}
+	var plan *achile.Plan
+	if *dryRun {
+		plan = achile.NewPlan(os.Stdout)
+		options = append(options, achile.WithPlan(plan))
+	}
+	scan, err := achile.NewScanner(*algo, "", options...)
 	if err != nil {
 		return err
 	}
@@ -35,7 +57,12 @@ func runTransfer(cmd *cli.Command, args []string) error {
 		if err != nil {
 			return err
 		}
-		fmt.Printf("%s - %d files %x (%s)\n", achile.FormatSize(cz.Size), cz.Count, scan.Checksum(), time.Since(now))
+		if plan == nil {
+			fmt.Printf("%s - %d files %x (%s)\n", achile.FormatSize(cz.Size), cz.Count, scan.Checksum(), time.Since(now))
+		}
+	}
+	if plan != nil {
+		return plan.Flush()
 	}
 	return nil
 }
@@ -46,17 +73,43 @@ func runCheck(cmd *cli.Command, args []string) error {
 		algo     = cmd.Flag.String("a", "", "algorithm")
 		verbose  = cmd.Flag.Bool("v", false, "verbose")
 		transfer = cmd.Flag.Bool("t", false, "synchronize")
+		mirror   = cmd.Flag.Bool("delete", false, "delete remote files missing locally")
+		dryRun   = cmd.Flag.Bool("dry-run", false, "only report the files that would be copied or deleted")
+		limit    = cmd.Flag.Int("max-delete", 100, "maximum number of remote files deleted (negative: no limit)")
+		progress = cmd.Flag.Bool("progress", false, "show progress")
+		remote   = registerRemote(cmd)
 	)
 	if err := cmd.Flag.Parse(args); err != nil {
 		return err
 	}
-	client, err := achile.NewClient(cmd.Flag.Arg(0), *algo)
+	if *mirror && !*transfer {
+		return fmt.Errorf("-delete can only be used with -t")
+	}
+	copts, err := remote.Options()
+	if err != nil {
+		return err
+	}
+	client, err := achile.NewClient(cmd.Flag.Arg(0), *algo, copts...)
 	if err != nil {
 		return err
 	}
 	defer client.Close()
 
-	scan, err := achile.NewScanner(*algo, "")
+	var options []achile.Option
+	if *progress {
+		p, err := startProgress([]string{cmd.Flag.Arg(1)}, *pattern)
+		if err != nil {
+			return err
+		}
+		defer p.Stop()
+		options = append(options, achile.WithProgress(p))
+	}
+	var plan *achile.Plan
+	if *dryRun {
+		plan = achile.NewPlan(os.Stdout)
+		options = append(options, achile.WithPlan(plan))
+	}
+	scan, err := achile.NewScanner(*algo, "", options...)
 	if err != nil {
 		return err
 	}
@@ -67,6 +120,59 @@ func runCheck(cmd *cli.Command, args []string) error {
 	if err != nil {
 		return err
 	}
+	if plan == nil {
+		fmt.Printf("%s - %d files %x (%s)\n", achile.FormatSize(cz.Size), cz.Count, scan.Checksum(), time.Since(now))
+	}
+	if *mirror {
+		list, err := scan.Prune(client, cmd.Flag.Arg(1), *pattern, *limit, *verbose)
+		if plan != nil {
+			if ferr := plan.Flush(); err == nil {
+				err = ferr
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d files deleted\n", len(list))
+	}
+	if plan != nil {
+		return plan.Flush()
+	}
+	return nil
+}
+
+func runFetch(cmd *cli.Command, args []string) error {
+	var (
+		pattern = cmd.Flag.String("p", "", "pattern")
+		algo    = cmd.Flag.String("a", "", "algorithm")
+		verbose = cmd.Flag.Bool("v", false, "verbose")
+		remote  = registerRemote(cmd)
+	)
+	if err := cmd.Flag.Parse(args); err != nil {
+		return err
+	}
+	copts, err := remote.Options()
+	if err != nil {
+		return err
+	}
+	client, err := achile.NewClient(cmd.Flag.Arg(0), *algo, copts...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	scan, err := achile.NewScanner(*algo, "")
+	if err != nil {
+		return err
+	}
+	defer scan.Close()
+
+	now := time.Now()
+	cz, err := scan.Fetch(client, cmd.Flag.Arg(1), *pattern, *verbose)
+	if err != nil {
+		return err
+	}
 	fmt.Printf("%s - %d files %x (%s)\n", achile.FormatSize(cz.Size), cz.Count, scan.Checksum(), time.Since(now))
 	return nil
 }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/busoc/achile"
+	"github.com/busoc/cli"
+)
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	if file == "" {
+		return x509.SystemCertPool()
+	}
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no valid certificate found", file)
+	}
+	return pool, nil
+}
+
+func serverConfig(pem, key, root string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(pem, key)
+	if err != nil {
+		return nil, err
+	}
+	cfg := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if root != "" {
+		if cfg.ClientCAs, err = loadCertPool(root); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return &cfg, nil
+}
+
+type remote struct {
+	tls    bool
+	ca     string
+	cert   string
+	key    string
+	server string
+	user   string
+	token  string
+
+	compress string
+	skip     string
+	window   int
+	conns    int
+	timeout  time.Duration
+	preserve bool
+}
+
+func registerRemote(cmd *cli.Command) *remote {
+	var r remote
+	cmd.Flag.BoolVar(&r.tls, "tls", false, "use tls")
+	cmd.Flag.StringVar(&r.ca, "ca", "", "certificate authority")
+	cmd.Flag.StringVar(&r.cert, "cert", "", "client certificate")
+	cmd.Flag.StringVar(&r.key, "key", "", "client key")
+	cmd.Flag.StringVar(&r.server, "server-name", "", "server name")
+	cmd.Flag.StringVar(&r.user, "user", "", "user")
+	cmd.Flag.StringVar(&r.token, "token", os.Getenv("ACHILE_TOKEN"), "token")
+	cmd.Flag.StringVar(&r.compress, "compress", "", "compression (gzip, deflate)")
+	cmd.Flag.StringVar(&r.skip, "compress-skip", "", "comma separated extensions of files sent uncompressed")
+	cmd.Flag.IntVar(&r.conns, "c", 1, "number of connections")
+	cmd.Flag.IntVar(&r.window, "pipeline", achile.DefaultWindow, "maximum number of requests waiting for a response")
+	cmd.Flag.DurationVar(&r.timeout, "timeout", achile.DefaultTimeout, "time to wait for a response")
+	cmd.Flag.BoolVar(&r.preserve, "preserve", false, "preserve mode, modification time and owner of files copied")
+	return &r
+}
+
+func (r *remote) Options() ([]achile.ClientOption, error) {
+	opts := []achile.ClientOption{
+		achile.WithPipeline(r.window),
+		achile.WithConnections(r.conns),
+		achile.WithTimeout(r.timeout),
+		achile.WithDialTimeout(r.timeout),
+	}
+	if r.tls || r.ca != "" || r.cert != "" || r.server != "" {
+		cfg, err := clientConfig(r.ca, r.cert, r.key, r.server)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, achile.WithTLS(cfg))
+	}
+	if r.preserve {
+		opts = append(opts, achile.WithMetadata())
+	}
+	if r.token != "" {
+		opts = append(opts, achile.WithCredentials(r.user, r.token))
+	}
+	if r.compress != "" {
+		var skip []string
+		if r.skip != "" {
+			skip = strings.Split(r.skip, ",")
+		}
+		opts = append(opts, achile.WithCompression(r.compress, skip...))
+	}
+	return opts, nil
+}
+
+func clientConfig(ca, pem, key, server string) (*tls.Config, error) {
+	var (
+		cfg = tls.Config{
+			ServerName: server,
+			MinVersion: tls.VersionTLS12,
+		}
+		err error
+	)
+	if cfg.RootCAs, err = loadCertPool(ca); err != nil {
+		return nil, err
+	}
+	if pem != "" {
+		cert, err := tls.LoadX509KeyPair(pem, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return &cfg, nil
+}
@@ -6,8 +6,9 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
 	"os"
-	"path/filepath"
 )
 
 const (
@@ -18,7 +19,10 @@ const (
 )
 
 type Comparer struct {
-	digest *Digest
+	alg      string
+	digest   *Digest
+	fsys     fs.FS
+	progress *Progress
 
 	pretty  bool
 	verbose bool
@@ -32,6 +36,16 @@ func NewComparer(file string, opts ...Option) (*Comparer, error) {
 	if err != nil {
 		return nil, err
 	}
+	c, err := NewComparerReader(r, opts...)
+	if err != nil {
+		r.Close()
+	}
+	return c, err
+}
+
+// NewComparerReader returns a comparer reading the list of known hashes from
+// r, such as the list returned by Client.Scan.
+func NewComparerReader(r io.Reader, opts ...Option) (*Comparer, error) {
 	var (
 		buf = make([]byte, 16)
 		alg string
@@ -41,12 +55,20 @@ func NewComparer(file string, opts ...Option) (*Comparer, error) {
 	}
 	alg = string(bytes.Trim(buf, "\x00"))
 
-	var c Comparer
+	var (
+		c   Comparer
+		err error
+	)
 	if c.digest, err = NewDigest(alg); err != nil {
 		return nil, err
 	}
+	c.alg = alg
 	c.inner = bufio.NewReader(r)
-	c.Closer = r
+	if rc, ok := r.(io.Closer); ok {
+		c.Closer = rc
+	} else {
+		c.Closer = ioutil.NopCloser(r)
+	}
 
 	for _, o := range opts {
 		o(&c)
@@ -56,12 +78,14 @@ func NewComparer(file string, opts ...Option) (*Comparer, error) {
 }
 
 func (c *Comparer) List(dirs []string) (Coze, error) {
-	for i := range dirs {
-		dirs[i] = filepath.Clean(dirs[i])
-	}
 	var cz Coze
+	roots, err := c.openRoots(dirs)
+	if err != nil {
+		return cz, err
+	}
+	defer roots.Close()
 	for i := range FetchInfos(c.inner, c.digest.Size()) {
-		fi, found := c.lookupFile(i, dirs)
+		fi, found := c.lookupFile(i, roots)
 		if !found {
 			return cz, fmt.Errorf("%s: no such file", fi.File)
 		}
@@ -78,13 +102,36 @@ func (c *Comparer) List(dirs []string) (Coze, error) {
 }
 
 func (c *Comparer) Compare(dirs []string) (Coze, error) {
-	for i := range dirs {
-		dirs[i] = filepath.Clean(dirs[i])
+	roots, err := c.openRoots(dirs)
+	if err != nil {
+		return Coze{}, err
+	}
+	defer roots.Close()
+
+	cz, err := c.compareFiles(roots, nil)
+	if err == nil {
+		_, err = c.compare(cz)
 	}
-	cz, err := c.compareFiles(dirs)
+	return cz, err
+}
+
+// Diff compares the files of the list like Compare and reports then the files
+// of dirs matching pattern that are not in the list as added.
+func (c *Comparer) Diff(dirs []string, pattern string) (Coze, error) {
+	roots, err := c.openRoots(dirs)
+	if err != nil {
+		return Coze{}, err
+	}
+	defer roots.Close()
+
+	seen := make(map[string]struct{})
+	cz, err := c.compareFiles(roots, seen)
 	if err == nil {
 		_, err = c.compare(cz)
 	}
+	if err1 := c.addedFiles(roots, pattern, seen); err == nil {
+		err = err1
+	}
 	return cz, err
 }
 
@@ -92,18 +139,27 @@ func (c *Comparer) Checksum() []byte {
 	return c.digest.Global()
 }
 
-func (c *Comparer) compareFiles(dirs []string) (Coze, error) {
+// compareFiles compares the files of the list with the files of roots. The
+// names of the files of the list, as sent to the server, are added to seen
+// when it is not nil.
+func (c *Comparer) compareFiles(roots roots, seen map[string]struct{}) (Coze, error) {
 	var (
 		cz Coze
 		st byte
 	)
 	for i := range FetchInfos(c.inner, c.digest.Size()) {
-		fi, found := c.lookupFile(i, dirs)
+		if seen != nil {
+			seen[remoteName(i.File)] = struct{}{}
+		}
+		fi, found := c.lookupFile(i, roots)
 		if found {
+			c.progress.update(i.File)
 			st = Identical
 			if err := c.digestFile(fi); err != nil {
 				st = Modified
 			}
+			c.digest.commit()
+			c.progress.complete(fi.Size)
 			cz.Update(fi.Size)
 		} else {
 			st = Deleted
@@ -120,6 +176,37 @@ func (c *Comparer) compareFiles(dirs []string) (Coze, error) {
 	return cz, nil
 }
 
+// addedFiles reports the files of roots matching pattern that are not in
+// seen. A file is only reported once, for the first root where it is found.
+func (c *Comparer) addedFiles(roots roots, pattern string, seen map[string]struct{}) error {
+	var err error
+	for _, r := range roots {
+		queue, err1 := FetchFilesFS(r.fsys, r.dir, pattern)
+		if err1 != nil {
+			return err1
+		}
+		for e := range queue {
+			name := remoteName(relativePath(r.fsys, e.File, r.dir))
+			if _, ok := seen[name]; ok || err != nil {
+				continue
+			}
+			seen[name] = struct{}{}
+			d, _ := NewDigest(c.alg)
+			if err = e.Compute(d); err != nil {
+				continue
+			}
+			if c.verbose {
+				if c.pretty {
+					fmt.Printf("%c  %-8s  %x  %s\n", Added, FormatSize(e.Size), d.Local(), e.File)
+				} else {
+					fmt.Printf("%c  %-12d  %x  %s\n", Added, int64(e.Size), d.Local(), e.File)
+				}
+			}
+		}
+	}
+	return err
+}
+
 func (c *Comparer) compare(cz Coze) (Coze, error) {
 	var z Coze
 	binary.Read(c.inner, binary.BigEndian, &z.Count)
@@ -138,12 +225,33 @@ func (c *Comparer) compare(cz Coze) (Coze, error) {
 	return z, nil
 }
 
-func (c *Comparer) lookupFile(fi FileInfo, dirs []string) (FileInfo, bool) {
-	var found bool
+func (c *Comparer) openRoots(dirs []string) (roots, error) {
+	var rs roots
 	for _, d := range dirs {
-		file := filepath.Join(d, fi.File)
-		if s, err := os.Stat(file); err == nil && s.Mode().IsRegular() {
-			fi.File, found = file, true
+		r := root{
+			fsys: c.fsys,
+			dir:  d,
+		}
+		if r.fsys == nil && IsArchive(d) {
+			a, err := OpenArchive(d)
+			if err != nil {
+				rs.Close()
+				return nil, err
+			}
+			r.fsys, r.dir, r.closer = a, ".", a
+		}
+		r.dir = cleanPath(r.fsys, r.dir)
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func (c *Comparer) lookupFile(fi FileInfo, roots roots) (FileInfo, bool) {
+	var found bool
+	for _, r := range roots {
+		file := joinPath(r.fsys, r.dir, fi.File)
+		if s, err := statFile(r.fsys, file); err == nil && s.Mode().IsRegular() {
+			fi.File, fi.fsys, found = file, r.fsys, true
 			break
 		}
 	}
@@ -151,18 +259,18 @@ func (c *Comparer) lookupFile(fi FileInfo, dirs []string) (FileInfo, bool) {
 }
 
 func (c *Comparer) digestFile(fi FileInfo) error {
-	r, err := os.Open(fi.File)
+	r, err := openFile(fi.fsys, fi.File)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
 
-	n, err := io.Copy(c.digest, r)
+	n, err := io.Copy(c.progress.writerTo(c.digest), r)
 	if err != nil {
 		return err
 	}
 	if n != int64(fi.Size) {
-		return fmt.Errorf("%s: size mismatched (%f != %d)!", fi.Size, fi.Size, n)
+		return fmt.Errorf("%s: size mismatched (%d != %d)!", fi.File, int64(fi.Size), n)
 	}
 	if sum := c.digest.Local(); !bytes.Equal(fi.Curr, sum) {
 		return fmt.Errorf("%s: checksum mismatched (%x != %x)!", fi.File, fi.Curr, sum)
@@ -170,8 +278,37 @@ func (c *Comparer) digestFile(fi FileInfo) error {
 	return nil
 }
 
+type root struct {
+	fsys   fs.FS
+	dir    string
+	closer io.Closer
+}
+
+type roots []root
+
+func (rs roots) Close() error {
+	var err error
+	for _, r := range rs {
+		if r.closer == nil {
+			continue
+		}
+		if e := r.closer.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 func (c *Comparer) setVerbose(v bool) { c.verbose = v }
 
 func (c *Comparer) setPretty(v bool) { c.pretty = v }
 
 func (c *Comparer) setError(v bool) {}
+
+func (c *Comparer) setFS(fsys fs.FS) { c.fsys = fsys }
+
+func (c *Comparer) setCache(_ *Cache) {}
+
+func (c *Comparer) setProgress(p *Progress) { c.progress = p }
+
+func (c *Comparer) setPlan(_ *Plan) {}
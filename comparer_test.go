@@ -0,0 +1,94 @@
+package achile
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffCurrentDirectory(t *testing.T) {
+	var (
+		tmp  = t.TempDir()
+		dir  = filepath.Join(tmp, "dir")
+		list = filepath.Join(tmp, "list")
+	)
+	for i := 0; i < 4; i++ {
+		file := filepath.Join(dir, fmt.Sprintf("d%d", i%2), fmt.Sprintf("f%02d.txt", i))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := NewScanner("sha256", list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Scan(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if err := os.WriteFile(filepath.Join(dir, "d1", "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	c, err := NewComparer(list, WithVerbose(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	out := captureStdout(t, func() {
+		if _, err := c.Diff([]string{"."}, ""); err != nil {
+			t.Errorf("diff: %s", err)
+		}
+	})
+	var added []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			t.Fatalf("unexpected line %q", line)
+		}
+		switch fields[0] {
+		case string(Identical):
+		case string(Added):
+			added = append(added, fields[3])
+		default:
+			t.Errorf("unexpected status: %s", line)
+		}
+	}
+	if len(added) != 1 || filepath.ToSlash(added[0]) != "d1/new.txt" {
+		t.Errorf("added files: %q, want [d1/new.txt]", added)
+	}
+}
+
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		bs, _ := ioutil.ReadAll(r)
+		done <- string(bs)
+	}()
+	fn()
+	os.Stdout = stdout
+	w.Close()
+	return <-done
+}
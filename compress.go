@@ -0,0 +1,181 @@
+package achile
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	CompressGzip    = "gzip"
+	CompressDeflate = "deflate"
+)
+
+const chunkSize = 64 << 10
+
+// DefaultSkipCompress lists the extensions of the files that are already
+// compressed and that are sent as is even when compression is enabled.
+var DefaultSkipCompress = []string{
+	".gz", ".tgz", ".bz2", ".xz", ".zst", ".lz4", ".br", ".zip", ".7z", ".rar", ".jar",
+	".jpg", ".jpeg", ".png", ".gif", ".webp", ".heic",
+	".mp3", ".ogg", ".flac", ".mp4", ".mkv", ".avi", ".mov", ".webm",
+}
+
+// WithCompression compresses the content of the files sent with Copy with
+// the given method (gzip or deflate) if the server accepts it. Files whose
+// extension is in skip are sent uncompressed; DefaultSkipCompress is used
+// when skip is empty. Digests are always computed on the uncompressed
+// content.
+func WithCompression(method string, skip ...string) ClientOption {
+	if len(skip) == 0 {
+		skip = DefaultSkipCompress
+	}
+	return func(c *Client) {
+		c.compress = strings.ToLower(method)
+		c.skip = make(map[string]struct{})
+		for _, e := range skip {
+			e = strings.ToLower(strings.TrimSpace(e))
+			if !strings.HasPrefix(e, ".") {
+				e = "." + e
+			}
+			c.skip[e] = struct{}{}
+		}
+	}
+}
+
+func validCompression(method string) bool {
+	return method == CompressGzip || method == CompressDeflate
+}
+
+func (c *Client) compressible(file string) bool {
+	if c.compress == "" {
+		return false
+	}
+	_, ok := c.skip[strings.ToLower(filepath.Ext(file))]
+	return !ok
+}
+
+func compressWriter(method string, w io.Writer) (io.WriteCloser, error) {
+	switch method {
+	case CompressGzip:
+		return gzip.NewWriter(w), nil
+	case CompressDeflate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	default:
+		return nil, fmt.Errorf("%s: unsupported compression", method)
+	}
+}
+
+func compressReader(method string, r io.Reader) (io.Reader, error) {
+	switch method {
+	case CompressGzip:
+		return gzip.NewReader(r)
+	case CompressDeflate:
+		return flate.NewReader(r), nil
+	default:
+		return nil, fmt.Errorf("%s: unsupported compression", method)
+	}
+}
+
+// chunkWriter frames the compressed content in chunks prefixed by their
+// length so that the receiver can always find the end of the content, even
+// when it fails to decompress it. A chunk of zero length ends the content.
+type chunkWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func newChunkWriter(w io.Writer) *chunkWriter {
+	return &chunkWriter{
+		w:   w,
+		buf: make([]byte, 0, chunkSize),
+	}
+}
+
+func (c *chunkWriter) Write(bs []byte) (int, error) {
+	var n int
+	for len(bs) > 0 {
+		z := copy(c.buf[len(c.buf):cap(c.buf)], bs)
+		c.buf = c.buf[:len(c.buf)+z]
+		bs = bs[z:]
+		n += z
+		if len(c.buf) == cap(c.buf) {
+			if err := c.flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Close writes the content still buffered, if any, and the chunk of zero
+// length ending the content.
+func (c *chunkWriter) Close() error {
+	if len(c.buf) > 0 {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	return c.flush()
+}
+
+func (c *chunkWriter) flush() error {
+	if err := binary.Write(c.w, binary.BigEndian, uint32(len(c.buf))); err != nil {
+		return err
+	}
+	_, err := c.w.Write(c.buf)
+	c.buf = c.buf[:0]
+	return err
+}
+
+type chunkReader struct {
+	r      io.Reader
+	remain uint32
+	done   bool
+}
+
+func (c *chunkReader) Read(bs []byte) (int, error) {
+	if c.done {
+		return 0, io.EOF
+	}
+	if c.remain == 0 {
+		if err := binary.Read(c.r, binary.BigEndian, &c.remain); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if c.remain == 0 {
+			c.done = true
+			return 0, io.EOF
+		}
+	}
+	if uint32(len(bs)) > c.remain {
+		bs = bs[:c.remain]
+	}
+	n, err := c.r.Read(bs)
+	c.remain -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func compressTo(method string, w io.Writer, r io.Reader) error {
+	cw := newChunkWriter(w)
+	zw, err := compressWriter(method, cw)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
@@ -0,0 +1,88 @@
+package achile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func TestChunkRoundTrip(t *testing.T) {
+	sizes := []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 2 * chunkSize, 3*chunkSize + 17}
+	for _, z := range sizes {
+		data := make([]byte, z)
+		rand.New(rand.NewSource(int64(z))).Read(data)
+
+		var buf bytes.Buffer
+		cw := newChunkWriter(&buf)
+		if _, err := cw.Write(data); err != nil {
+			t.Errorf("%d: write: %s", z, err)
+			continue
+		}
+		if err := cw.Close(); err != nil {
+			t.Errorf("%d: close: %s", z, err)
+			continue
+		}
+		// one length per chunk of content and one for the empty chunk
+		// ending the content.
+		chunks := (z+chunkSize-1)/chunkSize + 1
+		if want := 4*chunks + z; buf.Len() != want {
+			t.Errorf("%d: %d bytes written, want %d", z, buf.Len(), want)
+		}
+		buf.WriteString("next")
+
+		got, err := ioutil.ReadAll(&chunkReader{r: &buf})
+		if err != nil {
+			t.Errorf("%d: read: %s", z, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%d: content mismatched (%d bytes read)", z, len(got))
+		}
+		if rest := buf.String(); rest != "next" {
+			t.Errorf("%d: unexpected data after content: %q", z, rest)
+		}
+	}
+}
+
+func TestChunkReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(10))
+	buf.WriteString("short")
+
+	_, err := ioutil.ReadAll(&chunkReader{r: &buf})
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("want %s, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("achile compresses the content of the files "), 10000)
+	for _, m := range []string{CompressGzip, CompressDeflate} {
+		var buf bytes.Buffer
+		if err := compressTo(m, &buf, bytes.NewReader(data)); err != nil {
+			t.Errorf("%s: compress: %s", m, err)
+			continue
+		}
+		cr := &chunkReader{r: &buf}
+		zr, err := compressReader(m, cr)
+		if err != nil {
+			t.Errorf("%s: reader: %s", m, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Errorf("%s: decompress: %s", m, err)
+			continue
+		}
+		io.Copy(ioutil.Discard, cr)
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: content mismatched", m)
+		}
+		if buf.Len() > 0 {
+			t.Errorf("%s: %d bytes not consumed", m, buf.Len())
+		}
+	}
+}
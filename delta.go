@@ -0,0 +1,509 @@
+package achile
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	minBlockSize = 2 << 10
+	maxBlockSize = 1 << 20
+
+	blockSumLen = 4 + md5.Size //binary.Size(blockSum{})
+
+	signatureTimeout = 5 * time.Minute
+)
+
+const (
+	opEnd uint8 = iota
+	opBlock
+	opLiteral
+)
+
+var errSignature = errors.New("signature")
+
+// signature describes the blocks of the copy of a file kept by the server.
+// Each block is identified by a weak rolling checksum, used to find candidate
+// blocks at any offset of the local file, and by its md5 sum to confirm the
+// match.
+type signature struct {
+	Block  uint32
+	Blocks []blockSum
+
+	index map[uint32][]int
+}
+
+type blockSum struct {
+	Weak   uint32
+	Strong [md5.Size]byte
+}
+
+func blockSize(size int64) uint32 {
+	z := uint32(math.Sqrt(float64(size)))
+	if z < minBlockSize {
+		z = minBlockSize
+	}
+	if z > maxBlockSize {
+		z = maxBlockSize
+	}
+	return z
+}
+
+// signatureFits reports whether the signature of a file of size bytes can be
+// sent in a single response. The files too large for their signature to fit
+// are copied instead.
+func signatureFits(size int64) bool {
+	var (
+		block = int64(blockSize(size))
+		count = (size + block - 1) / block
+	)
+	return codeLen+8+count*blockSumLen <= maxFrame
+}
+
+func computeSignature(r io.Reader, size int64) (*signature, error) {
+	s := signature{
+		Block: blockSize(size),
+	}
+	buf := make([]byte, s.Block)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			s.Blocks = append(s.Blocks, blockSum{
+				Weak:   weakSum(buf[:n]),
+				Strong: md5.Sum(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+func readSignature(r *bytes.Reader) (*signature, error) {
+	var (
+		s     signature
+		count uint32
+	)
+	binary.Read(r, binary.BigEndian, &s.Block)
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+	if s.Block == 0 || s.Block > maxBlockSize {
+		return nil, fmt.Errorf("invalid block size %d", s.Block)
+	}
+	if int64(count)*blockSumLen > int64(r.Len()) {
+		return nil, fmt.Errorf("%w: invalid block count %d", ErrProtocol, count)
+	}
+	s.Blocks = make([]blockSum, count)
+	if err := binary.Read(r, binary.BigEndian, s.Blocks); err != nil {
+		return nil, err
+	}
+	s.index = make(map[uint32][]int)
+	for i, b := range s.Blocks {
+		s.index[b.Weak] = append(s.index[b.Weak], i)
+	}
+	return &s, nil
+}
+
+func (s *signature) writeTo(w io.Writer) {
+	binary.Write(w, binary.BigEndian, s.Block)
+	binary.Write(w, binary.BigEndian, uint32(len(s.Blocks)))
+	binary.Write(w, binary.BigEndian, s.Blocks)
+}
+
+func (s *signature) match(weak uint32, data []byte) (int, bool) {
+	ix, ok := s.index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := md5.Sum(data)
+	for _, i := range ix {
+		if s.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// diff reads r and writes to w the instructions to rebuild its content from
+// the blocks of the signature: references to the blocks found in r and
+// literal data for the rest.
+func (s *signature) diff(r io.Reader, w io.Writer) error {
+	var (
+		rs      = bufio.NewReader(r)
+		buf     = make([]byte, 4*s.Block)
+		literal = make([]byte, 0, s.Block)
+		roll    rollingSum
+		lo, hi  int
+		eof     bool
+	)
+	flush := func() error {
+		if len(literal) == 0 {
+			return nil
+		}
+		binary.Write(w, binary.BigEndian, opLiteral)
+		binary.Write(w, binary.BigEndian, uint32(len(literal)))
+		_, err := w.Write(literal)
+		literal = literal[:0]
+		return err
+	}
+	fill := func() error {
+		lo, hi = 0, 0
+		n, err := io.ReadFull(rs, buf[:s.Block])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof, err = true, nil
+		}
+		hi = n
+		roll.reset(buf[lo:hi])
+		return err
+	}
+	if err := fill(); err != nil {
+		return err
+	}
+	for lo < hi {
+		if i, ok := s.match(roll.sum(), buf[lo:hi]); ok {
+			if err := flush(); err != nil {
+				return err
+			}
+			binary.Write(w, binary.BigEndian, opBlock)
+			binary.Write(w, binary.BigEndian, uint32(i))
+			if err := fill(); err != nil {
+				return err
+			}
+			continue
+		}
+		out := buf[lo]
+		literal = append(literal, out)
+		if len(literal) == cap(literal) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		lo++
+		if eof {
+			roll.shrink(out)
+			continue
+		}
+		c, err := rs.ReadByte()
+		if err == io.EOF {
+			eof = true
+			roll.shrink(out)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if hi == len(buf) {
+			hi = copy(buf, buf[lo:hi])
+			lo = 0
+		}
+		buf[hi] = c
+		hi++
+		roll.roll(out, c)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, opEnd)
+}
+
+// patch rebuilds a file from the instructions read from r, copying the
+// referenced blocks from src. All the instructions are consumed even if an
+// error occurs.
+func patch(r io.Reader, src io.ReaderAt, w io.Writer, block uint32) (int64, error) {
+	var (
+		n    int64
+		err  error
+		buf  = make([]byte, block)
+		fail = func(e error) {
+			if err == nil {
+				err = e
+				w = ioutil.Discard
+			}
+		}
+	)
+	for {
+		var op uint8
+		if e := binary.Read(r, binary.BigEndian, &op); e != nil {
+			return n, e
+		}
+		switch op {
+		case opEnd:
+			return n, err
+		case opBlock:
+			var i uint32
+			if e := binary.Read(r, binary.BigEndian, &i); e != nil {
+				return n, e
+			}
+			z, e := src.ReadAt(buf, int64(i)*int64(block))
+			if z == 0 {
+				fail(fmt.Errorf("invalid block %d", i))
+				continue
+			}
+			if e != nil && e != io.EOF {
+				fail(e)
+				continue
+			}
+			z, e = w.Write(buf[:z])
+			n += int64(z)
+			if e != nil {
+				fail(e)
+			}
+		case opLiteral:
+			var z uint32
+			if e := binary.Read(r, binary.BigEndian, &z); e != nil {
+				return n, e
+			}
+			c, e := io.CopyN(w, r, int64(z))
+			n += c
+			if e != nil {
+				if c < int64(z) {
+					return n, e
+				}
+				fail(e)
+			}
+		default:
+			return n, fmt.Errorf("unknown delta instruction %d", op)
+		}
+	}
+}
+
+// rollingSum is the weak checksum of rsync: it can be updated in constant
+// time when the window moves forward by one byte.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func weakSum(data []byte) uint32 {
+	var r rollingSum
+	r.reset(data)
+	return r.sum()
+}
+
+func (r *rollingSum) reset(data []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(data))
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c)
+	}
+}
+
+func (r *rollingSum) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rollingSum) shrink(out byte) {
+	r.a -= uint32(out)
+	r.b -= r.n * uint32(out)
+	r.n--
+}
+
+func (r *rollingSum) sum() uint32 {
+	return r.a&0xFFFF | r.b<<16
+}
+
+// Delta sends the content of file to the server as a sequence of blocks of
+// the copy already present on the server and of literal data. It falls back
+// to Copy when the server does not support delta transfers, has no copy of
+// the file or when the file is too large for its signature to be sent.
+func (c *Client) Delta(file string, e Entry, sum []byte) error {
+	if c.caps&CapDelta == 0 || !signatureFits(int64(e.Size)) {
+		return c.Copy(file, e, sum)
+	}
+	return c.pick().delta(file, e, sum)
+}
+
+func (c *Client) delta(file string, e Entry, sum []byte) error {
+	sig, err := c.signature(e)
+	if errors.Is(err, ErrFile) {
+		return c.Copy(file, e, sum)
+	}
+	if err != nil {
+		return err
+	}
+	r, err := openFile(e.fsys, file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	raw := []byte(remoteName(e.File))
+	cl, err := c.sendEntry(ReqDelta, e, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, e.Size)
+		w.Write(sum)
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		w.Write(raw)
+		binary.Write(w, binary.BigEndian, sig.Block)
+		c.writeMetadata(w, file, e)
+		return sig.diff(r, w)
+	})
+	if err != nil {
+		return err
+	}
+	return c.result(cl)
+}
+
+func (c *Client) signature(e Entry) (*signature, error) {
+	raw := []byte(remoteName(e.File))
+	cl, err := c.send(ReqSignature, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		_, err := w.Write(raw)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	timeout := signatureTimeout
+	if c.timeout > timeout {
+		timeout = c.timeout
+	}
+	code, body, err := c.wait(cl, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if code != CodeSignature {
+		if err := c.decode(code, body); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unexpected response code %08x", code)
+	}
+	return readSignature(body)
+}
+
+func (h *Handler) handleSignature(rs io.Reader) *Result {
+	var raw uint16
+	binary.Read(rs, binary.BigEndian, &raw)
+	name := make([]byte, raw)
+	if _, err := io.ReadFull(rs, name); err != nil {
+		return unhandledResult(err)
+	}
+	if err := h.allow(ReqSignature); err != nil {
+		return deniedResult(err)
+	}
+	file, err := h.resolve(string(name))
+	if err != nil {
+		return deniedResult(err)
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		return nosuchFileResult(string(name))
+	}
+	defer r.Close()
+
+	i, err := r.Stat()
+	if err != nil || !i.Mode().IsRegular() {
+		return nosuchFileResult(string(name))
+	}
+	if !signatureFits(i.Size()) {
+		return unhandledResult(fmt.Errorf("%s: file too large for a delta transfer", name))
+	}
+	sig, err := computeSignature(r, i.Size())
+	if err != nil {
+		return unhandledResult(err)
+	}
+	return &Result{
+		File: name,
+		Err:  errSignature,
+		Sig:  sig,
+	}
+}
+
+func (h *Handler) handleDelta(rs io.Reader, d *Digest) *Result {
+	dat := struct {
+		Size  float64
+		Sum   []byte
+		Raw   uint16
+		File  []byte
+		Block uint32
+	}{}
+
+	dat.Sum = make([]byte, d.Size())
+	binary.Read(rs, binary.BigEndian, &dat.Size)
+	if _, err := io.ReadFull(rs, dat.Sum); err != nil {
+		return unhandledResult(err)
+	}
+	binary.Read(rs, binary.BigEndian, &dat.Raw)
+	dat.File = make([]byte, dat.Raw)
+	if _, err := io.ReadFull(rs, dat.File); err != nil {
+		return unhandledResult(err)
+	}
+	if err := binary.Read(rs, binary.BigEndian, &dat.Block); err != nil {
+		return unhandledResult(err)
+	}
+	if dat.Block == 0 || dat.Block > maxBlockSize {
+		return unhandledResult(fmt.Errorf("invalid block size %d", dat.Block))
+	}
+	meta, err := h.readMetadata(rs)
+	if err != nil {
+		return unhandledResult(err)
+	}
+
+	discard := func(r *Result) *Result {
+		if _, err := patch(rs, bytes.NewReader(nil), ioutil.Discard, dat.Block); err != nil && r.IsValid() {
+			r = unhandledResult(err)
+		}
+		return r
+	}
+	file, err := h.writable(string(dat.File))
+	if err != nil {
+		return discard(deniedResult(err))
+	}
+	src, err := os.Open(file)
+	if err != nil {
+		return discard(nosuchFileResult(string(dat.File)))
+	}
+	defer src.Close()
+
+	w, err := h.createTemp(file)
+	if err != nil {
+		return discard(unhandledResult(err))
+	}
+	defer func() {
+		w.Close()
+		os.Remove(w.Name())
+	}()
+
+	n, err := patch(rs, src, io.MultiWriter(w, d), dat.Block)
+	if err != nil {
+		return unhandledResult(err)
+	}
+	if n != int64(dat.Size) {
+		return sizeMismatchResult(string(dat.File), int64(dat.Size), n)
+	}
+	if sum := d.Local(); !bytes.Equal(dat.Sum, sum) {
+		return checksumMismatchResult(string(dat.File), dat.Sum, sum)
+	}
+	if err := w.Sync(); err != nil {
+		return unhandledResult(err)
+	}
+	if err := w.Close(); err != nil {
+		return unhandledResult(err)
+	}
+	if err := h.applyMetadata(w.Name(), meta); err != nil {
+		return unhandledResult(err)
+	}
+	if err := os.Rename(w.Name(), file); err != nil {
+		return unhandledResult(err)
+	}
+	return validResult(string(dat.File), int64(dat.Size), dat.Sum)
+}
+
+func (r Result) writeSignature(w io.Writer) {
+	binary.Write(w, binary.BigEndian, CodeSignature)
+	r.Sig.writeTo(w)
+}
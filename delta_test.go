@@ -0,0 +1,147 @@
+package achile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	var (
+		rnd  = rand.New(rand.NewSource(1))
+		base = make([]byte, 256<<10)
+	)
+	rnd.Read(base)
+
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	modified := concat(base)
+	copy(modified[100<<10:], []byte("modified in the middle"))
+
+	data := []struct {
+		Name  string
+		Old   []byte
+		New   []byte
+		Small bool
+	}{
+		{Name: "identical", Old: base, New: base, Small: true},
+		{Name: "empty", Old: nil, New: nil},
+		{Name: "created", Old: nil, New: base},
+		{Name: "emptied", Old: base, New: nil},
+		{Name: "modified", Old: base, New: modified, Small: true},
+		{Name: "prepended", Old: base, New: concat([]byte("header"), base), Small: true},
+		{Name: "appended", Old: base, New: concat(base, []byte("trailer")), Small: true},
+		{Name: "truncated", Old: base, New: base[:len(base)-1000], Small: true},
+		{Name: "shifted", Old: base, New: concat(base[:1000], base[1001:]), Small: true},
+		{Name: "short", Old: base[:10], New: base[:20]},
+		{Name: "replaced", Old: base[:len(base)/2], New: base[len(base)/2:]},
+	}
+	for _, d := range data {
+		sig, err := computeSignature(bytes.NewReader(d.Old), int64(len(d.Old)))
+		if err != nil {
+			t.Errorf("%s: signature: %s", d.Name, err)
+			continue
+		}
+		var raw bytes.Buffer
+		sig.writeTo(&raw)
+		if sig, err = readSignature(bytes.NewReader(raw.Bytes())); err != nil {
+			t.Errorf("%s: read signature: %s", d.Name, err)
+			continue
+		}
+
+		var delta bytes.Buffer
+		if err := sig.diff(bytes.NewReader(d.New), &delta); err != nil {
+			t.Errorf("%s: diff: %s", d.Name, err)
+			continue
+		}
+		size := delta.Len()
+
+		var got bytes.Buffer
+		n, err := patch(&delta, bytes.NewReader(d.Old), &got, sig.Block)
+		if err != nil {
+			t.Errorf("%s: patch: %s", d.Name, err)
+			continue
+		}
+		if n != int64(len(d.New)) || !bytes.Equal(got.Bytes(), d.New) {
+			t.Errorf("%s: content mismatched after patch (%d bytes, want %d)", d.Name, n, len(d.New))
+		}
+		if delta.Len() > 0 {
+			t.Errorf("%s: %d bytes of delta not consumed", d.Name, delta.Len())
+		}
+		if d.Small && size > len(d.New)/10 {
+			t.Errorf("%s: delta too large (%d bytes for %d)", d.Name, size, len(d.New))
+		}
+	}
+}
+
+func TestPatchInvalidBlock(t *testing.T) {
+	var delta bytes.Buffer
+	delta.Write([]byte{opBlock, 0, 0, 0, 9})
+	delta.Write([]byte{opLiteral, 0, 0, 0, 4})
+	delta.WriteString("data")
+	delta.WriteByte(opEnd)
+
+	var got bytes.Buffer
+	if _, err := patch(&delta, bytes.NewReader(nil), &got, minBlockSize); err == nil {
+		t.Fatalf("invalid block accepted")
+	}
+	if delta.Len() > 0 {
+		t.Errorf("%d bytes of delta not consumed", delta.Len())
+	}
+}
+
+func TestSignatureLimits(t *testing.T) {
+	sizes := []struct {
+		Size int64
+		Fits bool
+	}{
+		{Size: 0, Fits: true},
+		{Size: 1 << 30, Fits: true},
+		{Size: 1 << 40, Fits: true},
+		{Size: 3 << 40, Fits: true},
+		{Size: 4 << 40, Fits: false},
+	}
+	for _, s := range sizes {
+		if got := signatureFits(s.Size); got != s.Fits {
+			t.Errorf("%d: signature fits: %t, want %t", s.Size, got, s.Fits)
+		}
+	}
+
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.BigEndian, uint32(minBlockSize))
+	binary.Write(&raw, binary.BigEndian, uint32(1<<31))
+	raw.Write(make([]byte, blockSumLen))
+	if _, err := readSignature(bytes.NewReader(raw.Bytes())); err == nil {
+		t.Errorf("signature with invalid block count accepted")
+	}
+
+	base := t.TempDir()
+	f, err := os.Create(filepath.Join(base, "huge"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := f.Truncate(4 << 40); err != nil {
+		t.Skipf("sparse file not supported: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "small"), []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	request := func(file string) *bytes.Buffer {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.BigEndian, uint16(len(file)))
+		buf.WriteString(file)
+		return &buf
+	}
+	h := Handler{base: base}
+	if r := h.handleSignature(request("small")); r.Err != errSignature {
+		t.Fatalf("signature not computed: %v", r.Err)
+	}
+	if r := h.handleSignature(request("huge")); r.Err == errSignature {
+		t.Errorf("signature of a file too large computed")
+	}
+}
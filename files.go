@@ -0,0 +1,206 @@
+package achile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultUmask fs.FileMode = 0022
+
+	dirMode  fs.FileMode = 0777
+	fileMode fs.FileMode = 0666
+
+	tempSuffix = ".achile"
+)
+
+var ErrPath = errors.New("invalid path")
+
+func WithUmask(mask fs.FileMode) HandlerOption {
+	return func(h *Handler) {
+		h.umask = mask & fs.ModePerm
+	}
+}
+
+func WithOwner(uid, gid int) HandlerOption {
+	return func(h *Handler) {
+		h.uid, h.gid = uid, gid
+	}
+}
+
+func remoteName(file string) string {
+	return strings.TrimLeft(filepath.ToSlash(file), "/")
+}
+
+func validName(name string) error {
+	if name == "" || strings.IndexByte(name, 0) >= 0 || strings.IndexByte(name, '\\') >= 0 {
+		return fmt.Errorf("%w: %q", ErrPath, name)
+	}
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return fmt.Errorf("%w: %s is absolute", ErrPath, name)
+	}
+	for _, p := range strings.Split(name, "/") {
+		if p == ".." {
+			return fmt.Errorf("%w: %s is outside of base directory", ErrPath, name)
+		}
+	}
+	return nil
+}
+
+func (h *Handler) resolve(name string) (string, error) {
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	file := filepath.Join(h.base, filepath.FromSlash(name))
+	if file == filepath.Clean(h.base) {
+		return "", fmt.Errorf("%w: %q", ErrPath, name)
+	}
+	base, err := filepath.EvalSymlinks(h.base)
+	if err != nil {
+		return "", err
+	}
+	dir := file
+	for {
+		_, err := os.Lstat(dir)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		dir = filepath.Dir(dir)
+	}
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(base, real); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s is outside of base directory", ErrPath, name)
+	}
+	return file, nil
+}
+
+func (h *Handler) mkdirAll(dir string) error {
+	i, err := os.Stat(dir)
+	if err == nil {
+		if !i.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: fs.ErrExist}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(dir); parent != dir {
+		if err := h.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	mode := dirMode &^ h.umask
+	if err := os.Mkdir(dir, mode); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return nil
+		}
+		return err
+	}
+	if err := os.Chmod(dir, mode); err != nil {
+		return err
+	}
+	return h.chown(dir)
+}
+
+func (h *Handler) createTemp(file string) (*os.File, error) {
+	w, err := createTempFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.Chmod(fileMode &^ h.umask); err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+	if err := h.chown(w.Name()); err != nil {
+		w.Close()
+		os.Remove(w.Name())
+		return nil, err
+	}
+	return w, nil
+}
+
+// createTempFile creates a new temporary file in the directory of file with a
+// random tag.
+func createTempFile(file string) (*os.File, error) {
+	tag := make([]byte, 8)
+	if _, err := rand.Read(tag); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(tempName(file, hex.EncodeToString(tag)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+// tempName returns the name of a temporary file for file. Its tag is followed
+// by a marker computed from the name of file and the tag, so that the files
+// of the users are not mistaken for temporary files.
+func tempName(file, tag string) string {
+	dir, base := filepath.Split(file)
+	return filepath.Join(dir, "."+base+"."+tag+"-"+tempMarker(base, tag)+tempSuffix)
+}
+
+func tempMarker(base, tag string) string {
+	h := fnv.New32a()
+	io.WriteString(h, base)
+	h.Write([]byte{0})
+	io.WriteString(h, tag)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// tempTag returns the tag of the temporary file name. It fails when name is
+// not the name of a temporary file.
+func tempTag(name string) (string, bool) {
+	if !strings.HasPrefix(name, ".") || !strings.HasSuffix(name, tempSuffix) {
+		return "", false
+	}
+	name = strings.TrimSuffix(name[1:], tempSuffix)
+	x := strings.LastIndexByte(name, '.')
+	if x < 0 {
+		return "", false
+	}
+	base, tag := name[:x], name[x+1:]
+	if x = strings.LastIndexByte(tag, '-'); x < 0 {
+		return "", false
+	}
+	tag, mark := tag[:x], tag[x+1:]
+	return tag, mark == tempMarker(base, tag)
+}
+
+func isTemp(name string) bool {
+	_, ok := tempTag(name)
+	return ok
+}
+
+// CleanTemp removes the temporary files left in base by interrupted
+// transfers. Partial files younger than keep are preserved so that their
+// transfer can be resumed.
+func CleanTemp(base string, keep time.Duration) error {
+	return filepath.WalkDir(base, func(file string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() || !isTemp(d.Name()) {
+			return nil
+		}
+		if i, err := d.Info(); err == nil && isPartial(file) && time.Since(i.ModTime()) < keep {
+			return nil
+		}
+		return os.Remove(file)
+	})
+}
+
+func (h *Handler) chown(file string) error {
+	if h.uid < 0 && h.gid < 0 {
+		return nil
+	}
+	return os.Lchown(file, h.uid, h.gid)
+}
@@ -0,0 +1,95 @@
+package achile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	data := []struct {
+		Name  string
+		Valid bool
+	}{
+		{Name: "file", Valid: true},
+		{Name: "dir/file", Valid: true},
+		{Name: "dir/../file", Valid: false},
+		{Name: "..", Valid: false},
+		{Name: "../file", Valid: false},
+		{Name: "dir/..", Valid: false},
+		{Name: "..file", Valid: true},
+		{Name: "dir/file..", Valid: true},
+		{Name: "/etc/passwd", Valid: false},
+		{Name: "", Valid: false},
+		{Name: "dir\\..\\file", Valid: false},
+		{Name: "file\x00", Valid: false},
+	}
+	for _, d := range data {
+		err := validName(d.Name)
+		if d.Valid && err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Name, err)
+		}
+		if !d.Valid && !errors.Is(err, ErrPath) {
+			t.Errorf("%q: expected %s, got %v", d.Name, ErrPath, err)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	var (
+		tmp   = t.TempDir()
+		base  = filepath.Join(tmp, "base")
+		other = filepath.Join(tmp, "other")
+	)
+	for _, d := range []string{filepath.Join(base, "dir"), other} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		filepath.Join(base, "inside"):        filepath.Join(base, "dir"),
+		filepath.Join(base, "outside"):       other,
+		filepath.Join(base, "dir", "parent"): tmp,
+		filepath.Join(tmp, "link"):           base,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symbolic links not supported: %s", err)
+		}
+	}
+	data := []struct {
+		Base  string
+		Name  string
+		Valid bool
+	}{
+		{Base: base, Name: "file", Valid: true},
+		{Base: base, Name: "dir/file", Valid: true},
+		{Base: base, Name: "new/dir/file", Valid: true},
+		{Base: base, Name: "inside/file", Valid: true},
+		{Base: base, Name: "outside", Valid: false},
+		{Base: base, Name: "outside/file", Valid: false},
+		{Base: base, Name: "outside/new/file", Valid: false},
+		{Base: base, Name: "dir/parent/other/file", Valid: false},
+		{Base: base, Name: "../other/file", Valid: false},
+		{Base: base, Name: "/etc/passwd", Valid: false},
+		{Base: base, Name: ".", Valid: false},
+		{Base: filepath.Join(tmp, "link"), Name: "dir/file", Valid: true},
+		{Base: filepath.Join(tmp, "link"), Name: "outside/file", Valid: false},
+	}
+	for _, d := range data {
+		h := Handler{base: d.Base}
+		file, err := h.resolve(d.Name)
+		if d.Valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", d.Name, err)
+			} else if want := filepath.Join(d.Base, filepath.FromSlash(d.Name)); file != want {
+				t.Errorf("%s: want %s, got %s", d.Name, want, file)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: resolved to %s outside of %s", d.Name, file, d.Base)
+		}
+	}
+}
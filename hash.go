@@ -5,7 +5,9 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/adler32"
@@ -53,10 +55,17 @@ func init() {
 	sort.Strings(Families)
 }
 
+var ErrState = errors.New("hash state can not be saved")
+
+// Digest computes the digest of a file (local) and the digest of a set of
+// files (global). The global digest is made of the digests of the files in
+// the order they are added to it.
 type Digest struct {
 	global hash.Hash
 	local  hash.Hash
 	io.Writer
+
+	sum []byte
 }
 
 func NewDigest(alg string) (*Digest, error) {
@@ -69,11 +78,14 @@ func NewDigest(alg string) (*Digest, error) {
 		return nil, err
 	}
 	dgt.local, _ = SelectHash(alg)
-	dgt.Writer = io.MultiWriter(dgt.global, dgt.local)
+	dgt.Writer = dgt.local
 	return &dgt, nil
 }
 
 func (d *Digest) Local() []byte {
+	if d.sum != nil {
+		return d.sum
+	}
 	return d.local.Sum(nil)
 }
 
@@ -87,11 +99,38 @@ func (d *Digest) Size() int {
 
 func (d *Digest) Reset() {
 	d.local.Reset()
+	d.sum = nil
 }
 
 func (d *Digest) ResetAll() {
 	d.local.Reset()
 	d.global.Reset()
+	d.sum = nil
+}
+
+func (d *Digest) State() ([]byte, error) {
+	m, ok := d.global.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, ErrState
+	}
+	return m.MarshalBinary()
+}
+
+func (d *Digest) Restore(state []byte) error {
+	u, ok := d.global.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return ErrState
+	}
+	return u.UnmarshalBinary(state)
+}
+
+// commit adds the digest of the current file to the global digest.
+func (d *Digest) commit() {
+	d.global.Write(d.Local())
+}
+
+func (d *Digest) setLocal(sum []byte) {
+	d.sum = sum
 }
 
 func SelectHash(alg string) (hash.Hash, error) {
@@ -226,6 +265,14 @@ func (n none) BlockSize() int {
 	return Size32
 }
 
+func (n none) MarshalBinary() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (n none) UnmarshalBinary(bs []byte) error {
+	return nil
+}
+
 type sum32 uint32
 
 func Sum32() hash.Hash {
@@ -259,6 +306,18 @@ func (s *sum32) BlockSize() int {
 	return Size32
 }
 
+func (s *sum32) MarshalBinary() ([]byte, error) {
+	return s.Sum(nil), nil
+}
+
+func (s *sum32) UnmarshalBinary(bs []byte) error {
+	if len(bs) != Size32 {
+		return fmt.Errorf("invalid hash state")
+	}
+	*s = sum32(binary.BigEndian.Uint32(bs))
+	return nil
+}
+
 type sum64 uint64
 
 func Sum64() hash.Hash {
@@ -291,3 +350,15 @@ func (s *sum64) Size() int {
 func (s *sum64) BlockSize() int {
 	return Size64
 }
+
+func (s *sum64) MarshalBinary() ([]byte, error) {
+	return s.Sum(nil), nil
+}
+
+func (s *sum64) UnmarshalBinary(bs []byte) error {
+	if len(bs) != Size64 {
+		return fmt.Errorf("invalid hash state")
+	}
+	*s = sum64(binary.BigEndian.Uint64(bs))
+	return nil
+}
@@ -0,0 +1,276 @@
+package achile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ProtocolVersion uint16 = 7
+
+const (
+	CapCompress uint32 = 1 << iota
+	CapResume
+	CapMetadata
+	CapDelta
+)
+
+var supportedCaps = CapCompress | CapResume | CapMetadata | CapDelta
+
+var (
+	ErrProtocol = errors.New("incompatible protocol")
+	ErrVersion  = errors.New("unsupported protocol version")
+)
+
+var magic = []byte("ACHL")
+
+type hello struct {
+	Version uint16
+	Caps    uint32
+	Algs    []string
+	Params  map[string]string
+}
+
+func newHello(caps uint32, algs ...string) hello {
+	return hello{
+		Version: ProtocolVersion,
+		Caps:    caps,
+		Algs:    algs,
+		Params:  make(map[string]string),
+	}
+}
+
+func (h hello) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	buf.Write(magic)
+	binary.Write(&buf, binary.BigEndian, h.Version)
+	binary.Write(&buf, binary.BigEndian, h.Caps)
+	buf.WriteByte(byte(len(h.Algs)))
+	for _, a := range h.Algs {
+		buf.WriteByte(byte(len(a)))
+		buf.WriteString(a)
+	}
+	keys := make([]string, 0, len(h.Params))
+	for k := range h.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf.WriteByte(byte(len(keys)))
+	for _, k := range keys {
+		v := h.Params[k]
+		buf.WriteByte(byte(len(k)))
+		buf.WriteString(k)
+		binary.Write(&buf, binary.BigEndian, uint16(len(v)))
+		buf.WriteString(v)
+	}
+	return io.Copy(w, &buf)
+}
+
+func readHello(r io.Reader) (hello, error) {
+	h := hello{
+		Params: make(map[string]string),
+	}
+	buf := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return h, err
+	}
+	if !bytes.Equal(buf, magic) {
+		return h, fmt.Errorf("%w: peer is not an achile peer or uses an older protocol", ErrProtocol)
+	}
+	if err := binary.Read(r, binary.BigEndian, &h.Version); err != nil {
+		return h, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &h.Caps); err != nil {
+		return h, err
+	}
+
+	readString := func(wide bool) (string, error) {
+		var z uint16
+		if wide {
+			if err := binary.Read(r, binary.BigEndian, &z); err != nil {
+				return "", err
+			}
+		} else {
+			var b uint8
+			if err := binary.Read(r, binary.BigEndian, &b); err != nil {
+				return "", err
+			}
+			z = uint16(b)
+		}
+		str := make([]byte, z)
+		_, err := io.ReadFull(r, str)
+		return string(str), err
+	}
+
+	var n uint8
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return h, err
+	}
+	for i := 0; i < int(n); i++ {
+		a, err := readString(false)
+		if err != nil {
+			return h, err
+		}
+		h.Algs = append(h.Algs, a)
+	}
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return h, err
+	}
+	for i := 0; i < int(n); i++ {
+		k, err := readString(false)
+		if err != nil {
+			return h, err
+		}
+		v, err := readString(true)
+		if err != nil {
+			return h, err
+		}
+		h.Params[k] = v
+	}
+	return h, nil
+}
+
+func checkVersion(local, remote uint16) error {
+	if local == remote {
+		return nil
+	}
+	return fmt.Errorf("%w: local version %d, remote version %d", ErrVersion, local, remote)
+}
+
+func (c *Client) init(alg string) error {
+	hi := newHello(supportedCaps&^(CapCompress|CapMetadata), alg)
+	if c.metadata {
+		hi.Caps |= CapMetadata
+	}
+	if c.session != "" {
+		hi.Params["session"] = c.session
+	}
+	if c.share != "" {
+		hi.Params["share"] = c.share
+	}
+	if c.compress != "" {
+		if !validCompression(c.compress) {
+			return fmt.Errorf("%s: unsupported compression", c.compress)
+		}
+		hi.Caps |= CapCompress
+		hi.Params["compress"] = c.compress
+	}
+	if _, err := hi.WriteTo(c.conn); err != nil {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+
+	h, err := readHello(c.conn)
+	if err != nil {
+		return err
+	}
+	if err := checkVersion(ProtocolVersion, h.Version); err != nil {
+		return err
+	}
+	c.caps = h.Caps
+	if c.caps&CapCompress == 0 {
+		c.compress = ""
+	}
+	rs := bufio.NewReader(c.conn)
+	_, code, body, err := readFrame(rs)
+	if err != nil {
+		return err
+	}
+	if err := c.decode(code, bytes.NewReader(body)); err != nil {
+		if errors.Is(err, ErrAlg) {
+			return fmt.Errorf("%w: %s (supported: %s)", ErrAlg, alg, strings.Join(h.Algs, ", "))
+		}
+		return err
+	}
+	if err := c.checkShare(h.Params); err != nil {
+		return err
+	}
+	go c.receive(rs)
+	return c.authenticate(h.Params)
+}
+
+func (h *Handler) init() error {
+	hi, err := readHello(h.conn)
+	if err != nil {
+		if errors.Is(err, ErrProtocol) {
+			// peers of older versions do not know about frames and only
+			// expect the code of the error followed by its message.
+			var buf bytes.Buffer
+			unhandledResult(err).writeTo(&buf)
+			io.Copy(h.conn, &buf)
+		}
+		return err
+	}
+	var (
+		res = newHello(hi.Caps&supportedCaps, Families...)
+		r   = emptyResult()
+	)
+	if err = checkVersion(ProtocolVersion, hi.Version); err == nil {
+		if len(hi.Algs) == 0 {
+			err = ErrAlg
+		} else if _, err = NewDigest(hi.Algs[0]); err != nil {
+			err = ErrAlg
+		} else {
+			h.alg = hi.Algs[0]
+		}
+	}
+	if err == nil {
+		err = validSessionID(hi.Params["session"])
+	}
+	if err == nil {
+		err = h.selectShare(hi.Params["share"], &res)
+	}
+	if h.preserve == 0 {
+		res.Caps &^= CapMetadata
+	}
+	if m := hi.Params["compress"]; res.Caps&CapCompress != 0 && validCompression(m) {
+		h.compress = m
+		res.Params["compress"] = m
+	} else {
+		res.Caps &^= CapCompress
+	}
+	if err == nil {
+		err = h.challenge(res.Params)
+	}
+	if err == nil {
+		h.sess, err = joinSession(h.base, hi.Params["session"], h.alg)
+	}
+	switch {
+	case errors.Is(err, ErrAlg):
+		r = algResult(err)
+	case err != nil:
+		r = unhandledResult(err)
+	default:
+		h.digest = h.sess.digest
+	}
+	h.caps = res.Caps
+
+	var buf bytes.Buffer
+	res.WriteTo(&buf)
+	writeFrame(&buf, 0, r)
+	if _, err1 := io.Copy(h.conn, &buf); err1 != nil && err == nil {
+		h.sess.leave()
+		err = err1
+	}
+	return err
+}
+
+func algResult(err error) *Result {
+	return &Result{
+		Err: ErrAlg,
+		Msg: err.Error(),
+	}
+}
+
+func (r Result) writeAlg(w io.Writer) {
+	binary.Write(w, binary.BigEndian, CodeAlg)
+	r.File = []byte(r.Msg)
+	r.writeFile(w)
+}
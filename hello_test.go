@@ -0,0 +1,59 @@
+package achile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestHelloAlg(t *testing.T) {
+	share := Share{
+		Name: "data",
+		Base: t.TempDir(),
+		Algs: []string{"sha256"},
+	}
+	addr := serve(t, "", nil, WithShares(share))
+	c, err := NewClient(addr+"/data", "md5")
+	if err == nil {
+		c.Close()
+		t.Fatalf("md5 accepted by share limited to sha256")
+	}
+	if !errors.Is(err, ErrAlg) {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestHelloLegacyPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		NewHandler(server, t.TempDir())
+		server.Close()
+	}()
+	go client.Write([]byte("legacy request"))
+
+	var code uint32
+	if err := binary.Read(client, binary.BigEndian, &code); err != nil {
+		t.Fatal(err)
+	}
+	if code != CodeUnexpected {
+		t.Fatalf("unexpected code %d", code)
+	}
+	var z uint16
+	if err := binary.Read(client, binary.BigEndian, &z); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, z)
+	if _, err := io.ReadFull(client, msg); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(msg, []byte(ErrProtocol.Error())) {
+		t.Errorf("unexpected message: %s", msg)
+	}
+	if n, err := client.Read(make([]byte, 1)); n > 0 || err != io.EOF {
+		t.Errorf("unexpected data after the error (%d, %v)", n, err)
+	}
+}
@@ -0,0 +1,134 @@
+package achile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var ErrBusy = errors.New("server busy")
+
+const rejectTimeout = 5 * time.Second
+
+// WithIdleTimeout closes the connection of a client that does not send or
+// receive anything during d.
+func WithIdleTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.idle = d
+	}
+}
+
+// WithSessionTimeout closes the connection of a client d after it has been
+// accepted, whatever the client is doing.
+func WithSessionTimeout(d time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.lifetime = d
+	}
+}
+
+// Reject answers the handshake of a client that can not be served, because
+// the server has too many clients for example, with the reason err and closes
+// the connection.
+func Reject(conn net.Conn, reason error) error {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	if _, err := readHello(conn); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	newHello(0, Families...).WriteTo(&buf)
+	writeFrame(&buf, 0, busyResult(reason))
+	_, err := io.Copy(conn, &buf)
+	return err
+}
+
+// Shutdown makes Handle return once the requests being processed are done.
+// A client waiting for the response of its last request is not interrupted
+// but the requests it sends afterwards are not processed.
+func (h *Handler) Shutdown() {
+	h.smu.Lock()
+	defer h.smu.Unlock()
+	h.stopped = true
+	if h.waiting {
+		h.conn.SetReadDeadline(time.Unix(1, 0))
+	}
+}
+
+// await reports whether Handle can wait for the next request of the client.
+func (h *Handler) await(waiting bool) bool {
+	h.smu.Lock()
+	defer h.smu.Unlock()
+	h.waiting = waiting
+	return !h.stopped
+}
+
+// deadline returns the time after which the connection is closed if nothing
+// is read from or written to it.
+func (h *Handler) deadline() time.Time {
+	var t time.Time
+	if h.idle > 0 {
+		t = time.Now().Add(h.idle)
+	}
+	if h.lifetime > 0 {
+		end := h.started.Add(h.lifetime)
+		if t.IsZero() || end.Before(t) {
+			t = end
+		}
+	}
+	return t
+}
+
+type deadlineReader struct {
+	h *Handler
+}
+
+func (r deadlineReader) Read(bs []byte) (int, error) {
+	h := r.h
+	h.smu.Lock()
+	h.extend()
+	h.smu.Unlock()
+	return h.conn.Read(bs)
+}
+
+// track counts the checks processed in the background. The idle deadline of
+// the connection starts again once a check is done.
+func (h *Handler) track(n int) {
+	h.smu.Lock()
+	defer h.smu.Unlock()
+	h.running += n
+	h.extend()
+}
+
+// extend sets the read deadline of the connection. The client is not idle
+// while it waits for the results of its checks: only the session timeout
+// applies until they are done.
+func (h *Handler) extend() {
+	switch {
+	case h.stopped && h.waiting:
+		h.conn.SetReadDeadline(time.Unix(1, 0))
+	case h.running > 0:
+		var t time.Time
+		if h.lifetime > 0 {
+			t = h.started.Add(h.lifetime)
+		}
+		h.conn.SetReadDeadline(t)
+	default:
+		h.conn.SetReadDeadline(h.deadline())
+	}
+}
+
+func busyResult(err error) *Result {
+	return &Result{
+		Err: ErrBusy,
+		Msg: err.Error(),
+	}
+}
+
+func (r Result) writeBusy(w io.Writer) {
+	binary.Write(w, binary.BigEndian, CodeBusy)
+	r.File = []byte(r.Msg)
+	r.writeFile(w)
+}
@@ -0,0 +1,124 @@
+package achile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"time"
+)
+
+type Preserve uint8
+
+const (
+	PreserveMode Preserve = 1 << iota
+	PreserveTime
+	PreserveOwner
+)
+
+// ParsePreserve parses a comma separated list of the metadata to preserve
+// (mode, mtime, owner or all).
+func ParsePreserve(str string) (Preserve, error) {
+	var p Preserve
+	for _, s := range strings.Split(str, ",") {
+		switch strings.ToLower(strings.TrimSpace(s)) {
+		case "":
+		case "mode":
+			p |= PreserveMode
+		case "mtime", "time":
+			p |= PreserveTime
+		case "owner":
+			p |= PreserveOwner
+		case "all":
+			p |= PreserveMode | PreserveTime | PreserveOwner
+		default:
+			return p, fmt.Errorf("%s: unknown metadata", s)
+		}
+	}
+	return p, nil
+}
+
+// WithMetadata sends the mode, the modification time and the owner of the
+// files copied to the server. The server applies the metadata that it has
+// been configured to preserve.
+func WithMetadata() ClientOption {
+	return func(c *Client) {
+		c.metadata = true
+	}
+}
+
+// WithPreserve sets the metadata sent by the clients that the handler applies
+// to the files it writes once their content has been verified. A preserved
+// mode is applied as is, regardless of the umask.
+func WithPreserve(p Preserve) HandlerOption {
+	return func(h *Handler) {
+		h.preserve = p
+	}
+}
+
+type metadata struct {
+	Mode  uint32
+	Mtime int64
+	Uid   int32
+	Gid   int32
+}
+
+func metadataOf(fsys fs.FS, file string, i fs.FileInfo) metadata {
+	m := metadata{
+		Uid: -1,
+		Gid: -1,
+	}
+	if i == nil {
+		var err error
+		if i, err = statFile(fsys, file); err != nil {
+			return m
+		}
+	}
+	m.Mode = uint32(i.Mode().Perm())
+	m.Mtime = i.ModTime().UnixNano()
+	if uid, gid := statOwner(i); uid >= 0 {
+		m.Uid, m.Gid = int32(uid), int32(gid)
+	}
+	return m
+}
+
+func (c *Client) writeMetadata(w io.Writer, file string, e Entry) {
+	if c.caps&CapMetadata == 0 {
+		return
+	}
+	binary.Write(w, binary.BigEndian, metadataOf(e.fsys, file, e.info))
+}
+
+func (h *Handler) readMetadata(r io.Reader) (metadata, error) {
+	var m metadata
+	if h.caps&CapMetadata == 0 {
+		return m, nil
+	}
+	err := binary.Read(r, binary.BigEndian, &m)
+	return m, err
+}
+
+func (h *Handler) applyMetadata(file string, m metadata) error {
+	if h.caps&CapMetadata == 0 {
+		return nil
+	}
+	if h.preserve&PreserveMode != 0 {
+		if err := os.Chmod(file, fs.FileMode(m.Mode)&fs.ModePerm); err != nil {
+			return err
+		}
+	}
+	if h.preserve&PreserveOwner != 0 && m.Uid >= 0 {
+		if err := os.Lchown(file, int(m.Uid), int(m.Gid)); err != nil {
+			return err
+		}
+	}
+	if h.preserve&PreserveTime != 0 && m.Mtime != 0 {
+		mtime := time.Unix(0, m.Mtime)
+		if err := os.Chtimes(file, time.Now(), mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package achile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrLimit = errors.New("too many files to delete")
+
+// WithTrash moves the files deleted by the clients to dir instead of
+// removing them. dir has to be on the same file system as the base directory.
+func WithTrash(dir string) HandlerOption {
+	if abs, err := filepath.Abs(dir); err == nil && dir != "" {
+		dir = abs
+	}
+	return func(h *Handler) {
+		h.trash = dir
+	}
+}
+
+// Delete removes a file from the server.
+func (c *Client) Delete(file string) error {
+	raw := []byte(remoteName(file))
+	return c.roundTrip(ReqDelete, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		_, err := w.Write(raw)
+		return err
+	})
+}
+
+// Prune deletes the files of the server matching pattern that do not exist
+// in base. Nothing is deleted when more than limit files would be deleted,
+// unless limit is negative. The files deleted, or that would be deleted when
+// the scanner has a plan, are returned.
+func (s *Scanner) Prune(client *Client, base, pattern string, limit int, verbose bool) ([]Entry, error) {
+	local, err := s.localFiles(base)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := client.List(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var list []Entry
+	for _, e := range remote {
+		if _, ok := local[e.File]; !ok {
+			list = append(list, e)
+		}
+	}
+	if s.plan != nil {
+		for _, e := range list {
+			s.plan.add(Deleted, e, nil)
+		}
+	}
+	if limit >= 0 && len(list) > limit {
+		return list, fmt.Errorf("%w: %d files (limit: %d)", ErrLimit, len(list), limit)
+	}
+	if s.plan != nil {
+		return list, nil
+	}
+	for _, e := range list {
+		if err := client.Delete(e.File); err != nil {
+			return list, err
+		}
+		if verbose {
+			fmt.Printf("%c  %-12d  %s\n", Deleted, int64(e.Size), e.File)
+		}
+	}
+	return list, nil
+}
+
+// localFiles returns the names of all the files found in base, whatever their
+// size and type, so that no file is deleted from the server while it exists
+// locally. Unlike FetchFiles, it fails when base can not be walked entirely.
+func (s *Scanner) localFiles(base string) (map[string]struct{}, error) {
+	fsys := s.fsys
+	if fsys == nil && IsArchive(base) {
+		a, err := OpenArchive(base)
+		if err != nil {
+			return nil, err
+		}
+		defer a.Close()
+		fsys, base = a, "."
+	}
+	var (
+		files = make(map[string]struct{})
+		walk  = func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				files[remoteName(relativePath(fsys, file, base))] = struct{}{}
+			}
+			return nil
+		}
+		err error
+	)
+	base = cleanPath(fsys, base)
+	if fsys == nil {
+		err = filepath.WalkDir(base, walk)
+	} else {
+		err = fs.WalkDir(fsys, base, walk)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: files not deleted: %w", base, err)
+	}
+	return files, nil
+}
+
+func (h *Handler) handleDelete(rs io.Reader) *Result {
+	d := decoder{r: rs}
+	name := d.string()
+	if d.err != nil {
+		return unhandledResult(d.err)
+	}
+	file, err := h.writable(name)
+	if err != nil {
+		return deniedResult(err)
+	}
+	i, err := os.Lstat(file)
+	if err != nil || !i.Mode().IsRegular() || h.hidden(file) {
+		return nosuchFileResult(name)
+	}
+	if h.trash != "" {
+		err = h.moveToTrash(file, name)
+	} else {
+		err = os.Remove(file)
+	}
+	if err != nil {
+		return unhandledResult(err)
+	}
+	h.removeEmpty(filepath.Dir(file))
+	return validResult(name, i.Size(), nil)
+}
+
+func (h *Handler) moveToTrash(file, name string) error {
+	dst := filepath.Join(h.trash, filepath.FromSlash(name))
+	if err := h.mkdirAll(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		dst += "." + time.Now().Format("20060102T150405.000")
+	}
+	return os.Rename(file, dst)
+}
+
+// removeEmpty removes dir and its parents, up to the base directory, when
+// they are empty.
+func (h *Handler) removeEmpty(dir string) {
+	base := filepath.Clean(h.base)
+	for dir != base && strings.HasPrefix(dir, base+string(filepath.Separator)) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// hidden reports whether a file of the base directory is used by the server
+// itself and has to be ignored by the requests of the clients.
+func (h *Handler) hidden(file string) bool {
+	if isTemp(filepath.Base(file)) {
+		return true
+	}
+	if h.trash == "" {
+		return false
+	}
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	rel, err := filepath.Rel(h.trash, file)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
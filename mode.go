@@ -0,0 +1,98 @@
+package achile
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+// Mode restricts the requests that the clients of a server or of a share can
+// send. The modes are ordered from the least to the most restrictive.
+type Mode uint8
+
+const (
+	// ReadWrite accepts all the requests.
+	ReadWrite Mode = iota
+	// ReadOnly accepts the requests that do not modify the files: check,
+	// compare, list, fetch and scan.
+	ReadOnly
+	// VerifyOnly only accepts check and compare requests.
+	VerifyOnly
+)
+
+func ParseMode(str string) (Mode, error) {
+	switch strings.ToLower(str) {
+	case "", "read-write", "rw":
+		return ReadWrite, nil
+	case "read-only", "ro":
+		return ReadOnly, nil
+	case "verify-only", "verify":
+		return VerifyOnly, nil
+	default:
+		return ReadWrite, fmt.Errorf("%s: unknown mode", str)
+	}
+}
+
+func (m Mode) String() string {
+	switch m {
+	case ReadWrite:
+		return "read-write"
+	case ReadOnly:
+		return "read-only"
+	case VerifyOnly:
+		return "verify-only"
+	default:
+		return fmt.Sprintf("mode(%d)", m)
+	}
+}
+
+// WithMode restricts the requests accepted by the handler. The mode of a
+// share can only restrict them further.
+func WithMode(m Mode) HandlerOption {
+	return func(h *Handler) {
+		h.mode = m
+	}
+}
+
+// allow reports whether the mode of the handler accepts the request req.
+func (h *Handler) allow(req byte) error {
+	switch req {
+	case ReqAuth, ReqCheck, ReqCmp:
+		return nil
+	case ReqList, ReqFetch, ReqScan:
+		if h.mode <= ReadOnly {
+			return nil
+		}
+	default:
+		if h.mode == ReadWrite {
+			return nil
+		}
+	}
+	return forbiddenError(fmt.Sprintf("server is %s", h.mode))
+}
+
+// writable resolves the name of a file that a request modifies.
+func (h *Handler) writable(name string) (string, error) {
+	if h.mode != ReadWrite {
+		return "", forbiddenError(fmt.Sprintf("%s can not be modified (server is %s)", name, h.mode))
+	}
+	return h.resolve(name)
+}
+
+// forbiddenError is the reason sent to a client when a request is not
+// accepted by the mode of the handler.
+type forbiddenError string
+
+func (e forbiddenError) Error() string { return string(e) }
+
+func (e forbiddenError) Is(err error) bool { return err == ErrForbidden }
+
+func (r Result) writeForbidden(w io.Writer) {
+	binary.Write(w, binary.BigEndian, CodeForbidden)
+	r.File = []byte(r.Msg)
+	r.writeFile(w)
+}
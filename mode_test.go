@@ -0,0 +1,51 @@
+package achile
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModeReadOnlyShare(t *testing.T) {
+	var (
+		src   = filepath.Join(t.TempDir(), "file")
+		data  = []byte("content of file")
+		sum   = sha256.Sum256(data)
+		share = Share{
+			Name: "ro",
+			Base: t.TempDir(),
+			Mode: ReadOnly,
+		}
+		e = Entry{File: "file", Size: float64(len(data))}
+	)
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(share.Base, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, "", nil, WithShares(share))
+	c, err := NewClient(addr+"/ro", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Check(e, sum[:]); err != nil {
+		t.Errorf("check: %s", err)
+	}
+	if _, err := c.List(""); err != nil {
+		t.Errorf("list: %s", err)
+	}
+	if err := c.Copy(src, e, sum[:]); !errors.Is(err, ErrForbidden) {
+		t.Errorf("copy: unexpected error: %v", err)
+	}
+	if err := c.Delete("file"); !errors.Is(err, ErrForbidden) {
+		t.Errorf("delete: unexpected error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(share.Base, "file")); err != nil {
+		t.Errorf("file modified on a read-only share: %s", err)
+	}
+}
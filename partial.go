@@ -0,0 +1,225 @@
+package achile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const partialTag = "part"
+
+var errPartial = errors.New("partial")
+
+func partialFile(file string) string {
+	return tempName(file, partialTag)
+}
+
+func isPartial(file string) bool {
+	tag, ok := tempTag(filepath.Base(file))
+	return ok && tag == partialTag
+}
+
+// partials are the partial files being written by the handlers of the
+// server. A partial file is only written by one transfer at a time: the
+// other transfers of the same file use a temporary file of their own.
+var partials = struct {
+	sync.Mutex
+	files map[string]struct{}
+}{
+	files: make(map[string]struct{}),
+}
+
+func lockPartial(file string) bool {
+	partials.Lock()
+	defer partials.Unlock()
+	if _, ok := partials.files[file]; ok {
+		return false
+	}
+	partials.files[file] = struct{}{}
+	return true
+}
+
+func unlockPartial(file string) {
+	partials.Lock()
+	defer partials.Unlock()
+	delete(partials.files, file)
+}
+
+func partialBusy(file string) bool {
+	partials.Lock()
+	defer partials.Unlock()
+	_, ok := partials.files[file]
+	return ok
+}
+
+func (c *Client) resume(r io.Reader, e Entry, sum []byte) (int64, error) {
+	raw := []byte(remoteName(e.File))
+	cl, err := c.send(ReqPartial, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, e.Size)
+		w.Write(sum)
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		_, err := w.Write(raw)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	code, body, err := c.wait(cl, c.hashTimeout(e.Size))
+	if err != nil {
+		return 0, err
+	}
+	if code != CodePartial {
+		if err := c.decode(code, body); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("unexpected response code %08x", code)
+	}
+	var (
+		offset int64
+		prefix = make([]byte, c.hashlen)
+	)
+	binary.Read(body, binary.BigEndian, &offset)
+	if _, err := io.ReadFull(body, prefix); err != nil {
+		return 0, err
+	}
+	if offset <= 0 || offset > int64(e.Size) {
+		return 0, nil
+	}
+	h, err := SelectHash(c.alg)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := io.CopyN(h, r, offset); err != nil || n != offset {
+		return 0, err
+	}
+	if !bytes.Equal(prefix, h.Sum(nil)) {
+		return 0, nil
+	}
+	return offset, nil
+}
+
+func (h *Handler) handlePartial(rs io.Reader) *Result {
+	dat := struct {
+		Size float64
+		Sum  []byte
+		Raw  uint16
+		File []byte
+	}{}
+
+	binary.Read(rs, binary.BigEndian, &dat.Size)
+	dat.Sum = make([]byte, h.digest.Size())
+	if _, err := io.ReadFull(rs, dat.Sum); err != nil {
+		return unhandledResult(err)
+	}
+	binary.Read(rs, binary.BigEndian, &dat.Raw)
+	dat.File = make([]byte, dat.Raw)
+	if _, err := io.ReadFull(rs, dat.File); err != nil {
+		return unhandledResult(err)
+	}
+	if err := h.allow(ReqPartial); err != nil {
+		return deniedResult(err)
+	}
+	file, err := h.resolve(string(dat.File))
+	if err != nil {
+		return deniedResult(err)
+	}
+	sum, err := SelectHash(h.alg)
+	if err != nil {
+		return unhandledResult(err)
+	}
+	r := partialResult(string(dat.File), 0, sum.Sum(nil))
+	if partialBusy(partialFile(file)) {
+		return r
+	}
+
+	f, err := os.Open(partialFile(file))
+	if err != nil {
+		return r
+	}
+	defer f.Close()
+
+	i, err := f.Stat()
+	if err != nil || i.Size() == 0 || i.Size() > int64(dat.Size) {
+		return r
+	}
+	if _, err := io.CopyN(sum, f, i.Size()); err != nil {
+		return r
+	}
+	return partialResult(string(dat.File), i.Size(), sum.Sum(nil))
+}
+
+// openPartial opens the partial file of file to write its content from
+// offset. When the partial file is already written by another transfer, a
+// new temporary file is used instead. The returned function has to be called
+// once the file is closed.
+func (h *Handler) openPartial(file string, offset int64) (*os.File, func(), error) {
+	part := partialFile(file)
+	if !lockPartial(part) {
+		if offset > 0 {
+			return nil, nil, fmt.Errorf("%s: partial file in use", part)
+		}
+		w, err := h.createTemp(file)
+		return w, func() {}, err
+	}
+	w, err := h.createPartial(part, offset)
+	if err != nil {
+		unlockPartial(part)
+		return nil, nil, err
+	}
+	return w, func() { unlockPartial(part) }, nil
+}
+
+func (h *Handler) createPartial(file string, offset int64) (*os.File, error) {
+	w, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, fileMode&^h.umask)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		i, err := w.Stat()
+		if err == nil && i.Size() < offset {
+			err = fmt.Errorf("%s: partial file too short (%d < %d)", file, i.Size(), offset)
+		}
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	if err := w.Truncate(offset); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if _, err := w.Seek(offset, io.SeekStart); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Chmod(fileMode &^ h.umask); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := h.chown(file); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (r Result) writePartial(w io.Writer) {
+	binary.Write(w, binary.BigEndian, CodePartial)
+	binary.Write(w, binary.BigEndian, r.Offset)
+	w.Write(r.Sum.Got)
+}
+
+func partialResult(file string, offset int64, sum []byte) *Result {
+	r := Result{
+		File:   []byte(file),
+		Err:    errPartial,
+		Offset: offset,
+	}
+	r.Sum.Got = sum
+	return &r
+}
@@ -0,0 +1,439 @@
+package achile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWindow = 64
+
+	DefaultTimeout = 30 * time.Second
+
+	maxFrame = 1 << 26
+
+	// minHashRate is the lowest rate, in bytes per second, at which the
+	// server is expected to read back a file to compute its digest.
+	minHashRate = 8 << 20
+)
+
+// WithTimeout sets how long the client waits for the server to respond to a
+// request. Checks and signatures of large files are given more time to be
+// computed.
+func WithTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		if d > 0 {
+			c.timeout = d
+		}
+	}
+}
+
+// WithDialTimeout sets how long the client waits for a connection to the
+// server to be established.
+func WithDialTimeout(d time.Duration) ClientOption {
+	return func(c *Client) {
+		c.dialTimeout = d
+	}
+}
+
+// WithPipeline sets the maximum number of requests sent by the client while
+// waiting for their responses.
+func WithPipeline(n int) ClientOption {
+	return func(c *Client) {
+		if n > 0 {
+			c.window = n
+		}
+	}
+}
+
+// WithWorkers sets the number of requests that the handler processes in
+// parallel.
+func WithWorkers(n int) HandlerOption {
+	return func(h *Handler) {
+		h.workers = n
+	}
+}
+
+type call struct {
+	client *Client
+
+	id   uint32
+	name string
+	pos  uint64
+	done chan struct{}
+	data chan []byte
+
+	code    uint32
+	body    []byte
+	err     error
+	timeout time.Duration
+}
+
+// send writes a request to the server without waiting for its response. The
+// body of the request is written by fn. The connection is closed if the
+// request can not be written completely since the server would not be able
+// to find the beginning of the next request.
+func (c *Client) send(req byte, fn func(w io.Writer) error) (*call, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	if c.broken != nil {
+		c.mu.Unlock()
+		return nil, c.broken
+	}
+	c.id++
+	cl := call{
+		client: c,
+		id:     c.id,
+		done:   make(chan struct{}),
+	}
+	if req == ReqList || req == ReqFetch || req == ReqScan {
+		cl.data = make(chan []byte)
+	}
+	c.calls[cl.id] = &cl
+	c.mu.Unlock()
+
+	binary.Write(c.w, binary.BigEndian, req)
+	binary.Write(c.w, binary.BigEndian, cl.id)
+	err := fn(c.w)
+	if err == nil {
+		err = c.w.Flush()
+	}
+	if err != nil {
+		c.shutdown(err)
+		return nil, err
+	}
+	return &cl, nil
+}
+
+// sendEntry sends a request about a file whose content is added to the global
+// digest of the server. Each file gets a position in the sequence of files
+// sent by the client. A file that has been rejected by the server keeps its
+// position when it is sent again.
+func (c *Client) sendEntry(req byte, e Entry, fn func(w io.Writer) error) (*call, error) {
+	var (
+		name = remoteName(e.File)
+		pos  = c.seq.next(name)
+	)
+	cl, err := c.send(req, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, pos)
+		return fn(w)
+	})
+	if err == nil {
+		cl.name, cl.pos = name, pos
+	}
+	return cl, err
+}
+
+func (c *Client) roundTrip(req byte, fn func(w io.Writer) error) error {
+	cl, err := c.send(req, fn)
+	if err != nil {
+		return err
+	}
+	code, body, err := c.wait(cl, c.timeout)
+	if err != nil {
+		return err
+	}
+	return c.decode(code, body)
+}
+
+// hashTimeout gives the server the time to read back a file of up to size
+// bytes to compute its digest before it responds.
+func (c *Client) hashTimeout(size float64) time.Duration {
+	return c.timeout + time.Duration(size/minHashRate)*time.Second
+}
+
+func (c *Client) result(cl *call) error {
+	c = cl.client
+	timeout := cl.timeout
+	if timeout == 0 {
+		timeout = c.timeout
+	}
+	code, body, err := c.wait(cl, timeout)
+	if err == nil {
+		err = c.decode(code, body)
+	}
+	if errors.Is(err, ErrFile) || errors.Is(err, ErrSum) || errors.Is(err, ErrSize) {
+		c.seq.keep(cl.name, cl.pos)
+	}
+	return err
+}
+
+func (c *Client) wait(cl *call, timeout time.Duration) (uint32, *bytes.Reader, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-cl.done:
+	case <-t.C:
+		err := fmt.Errorf("no response from server after %s", timeout)
+		c.shutdown(err)
+		return 0, nil, err
+	}
+	if cl.err != nil {
+		return 0, nil, cl.err
+	}
+	return cl.code, bytes.NewReader(cl.body), nil
+}
+
+func (c *Client) receive(r io.Reader) {
+	for {
+		id, code, body, err := readFrame(r)
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		c.mu.Lock()
+		cl, ok := c.calls[id]
+		more := ok && cl.data != nil && code == CodeData
+		if ok && !more {
+			delete(c.calls, id)
+		}
+		c.mu.Unlock()
+		switch {
+		case more:
+			select {
+			case cl.data <- body:
+			case <-cl.done:
+			}
+		case ok:
+			cl.code, cl.body = code, body
+			close(cl.done)
+		}
+	}
+}
+
+func (c *Client) shutdown(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.broken != nil {
+		return
+	}
+	c.broken = err
+	c.conn.Close()
+	close(c.quit)
+	for id, cl := range c.calls {
+		cl.err = err
+		close(cl.done)
+		delete(c.calls, id)
+	}
+}
+
+func readFrame(r io.Reader) (uint32, uint32, []byte, error) {
+	var id, size uint32
+	if err := binary.Read(r, binary.BigEndian, &id); err != nil {
+		return 0, 0, nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return 0, 0, nil, err
+	}
+	if size < codeLen || size > maxFrame {
+		return 0, 0, nil, fmt.Errorf("%w: invalid response length %d", ErrProtocol, size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, 0, nil, err
+	}
+	return id, binary.BigEndian.Uint32(buf), buf[codeLen:], nil
+}
+
+func writeFrame(w io.Writer, id uint32, r *Result) {
+	var buf bytes.Buffer
+	r.writeTo(&buf)
+	binary.Write(w, binary.BigEndian, id)
+	binary.Write(w, binary.BigEndian, uint32(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// request is a request written to the server in the background by the
+// sender of a connection.
+type request struct {
+	call *call
+	err  error
+	done chan struct{}
+}
+
+// start writes a request to the server in the background. Each connection
+// has its own sender, so that the contents of several files are written at
+// once, one on each connection. fn returns either the call of the request or
+// its result when it has waited for it.
+func (c *Client) start(fn func(c *Client) (*call, error)) *request {
+	c.once.Do(func() {
+		c.jobs = make(chan func())
+		go func() {
+			for {
+				select {
+				case job := <-c.jobs:
+					job()
+				case <-c.quit:
+					return
+				}
+			}
+		}()
+	})
+	r := request{
+		done: make(chan struct{}),
+	}
+	job := func() {
+		r.call, r.err = fn(c)
+		close(r.done)
+	}
+	select {
+	case c.jobs <- job:
+	case <-c.quit:
+		c.mu.Lock()
+		r.err = c.broken
+		c.mu.Unlock()
+		close(r.done)
+	}
+	return &r
+}
+
+// pipeline processes, in the order they were sent, the responses to the
+// requests sent by a scanner while it keeps sending new requests. The
+// requests sent in the background, by the callbacks of the first requests,
+// are processed in a second stage.
+type pipeline struct {
+	queue chan pending
+	later chan pending
+	wg    sync.WaitGroup
+	busy  sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+type pending struct {
+	call *call
+	req  *request
+	fn   func(error) error
+}
+
+func newPipeline(c *Client) *pipeline {
+	size := c.window * (len(c.peers) + 1)
+	p := pipeline{
+		queue: make(chan pending, size),
+		later: make(chan pending, size),
+	}
+	p.wg.Add(2)
+	go func() {
+		p.run(c, p.queue)
+		close(p.later)
+	}()
+	go p.run(c, p.later)
+	return &p
+}
+
+func (p *pipeline) run(c *Client, queue chan pending) {
+	defer p.wg.Done()
+	for x := range queue {
+		if p.Err() == nil {
+			if err := x.fn(p.result(c, x)); err != nil {
+				p.fail(err)
+			}
+		}
+		p.busy.Done()
+	}
+}
+
+func (p *pipeline) result(c *Client, x pending) error {
+	if x.req != nil {
+		<-x.req.done
+		if x.call = x.req.call; x.req.err != nil || x.call == nil {
+			return x.req.err
+		}
+	}
+	return c.result(x.call)
+}
+
+func (p *pipeline) push(cl *call, fn func(error) error) {
+	p.busy.Add(1)
+	p.queue <- pending{
+		call: cl,
+		fn:   fn,
+	}
+}
+
+// then adds a request sent in the background to the second stage of the
+// pipeline. Unlike push, it can be called by the callbacks of the requests.
+func (p *pipeline) then(r *request, fn func(error) error) {
+	p.busy.Add(1)
+	p.later <- pending{
+		req: r,
+		fn:  fn,
+	}
+}
+
+// sync waits until all the responses have been processed.
+func (p *pipeline) sync() {
+	p.busy.Wait()
+}
+
+func (p *pipeline) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (p *pipeline) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *pipeline) close() error {
+	close(p.queue)
+	p.wg.Wait()
+	return p.Err()
+}
+
+type pendingFile struct {
+	size int64
+	sum  []byte
+}
+
+// newDigest returns the digest of the content of the file of a request. The
+// digest of the file is added to the global digest of the session once the
+// request has been completed.
+func (h *Handler) newDigest() *Digest {
+	d, _ := NewDigest(h.alg)
+	return d
+}
+
+// commit adds the digest of the file of a valid result to the global digest
+// of the session. Since requests are processed in parallel, the digests are
+// added in the order of the positions given by the client to its files and
+// not in the order the requests complete.
+func (h *Handler) commit(pos uint64, r *Result) *Result {
+	if !r.IsValid() {
+		return r
+	}
+	s := h.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[pos]; ok || pos < s.next {
+		return unhandledResult(fmt.Errorf("%w: file at position %d already received", ErrProtocol, pos))
+	}
+	s.pending[pos] = pendingFile{
+		size: r.Size.Got,
+		sum:  r.Sum.Got,
+	}
+	for {
+		p, ok := s.pending[s.next]
+		if !ok {
+			break
+		}
+		delete(s.pending, s.next)
+		s.digest.global.Write(p.sum)
+		s.cz.Update(float64(p.size))
+		s.next++
+	}
+	return r
+}
@@ -0,0 +1,89 @@
+package achile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommitOrder(t *testing.T) {
+	var (
+		sums  [][]byte
+		order = []uint64{2, 0, 3, 1}
+		want  = sha256.New()
+	)
+	for i := range order {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("file %d", i)))
+		sums = append(sums, sum[:])
+		want.Write(sum[:])
+	}
+	d, _ := NewDigest("sha256")
+	h := Handler{sess: newSession(d)}
+	for i, pos := range order {
+		r := h.commit(pos, validResult(fmt.Sprint(pos), int64(pos+1), sums[pos]))
+		if !r.IsValid() {
+			t.Fatalf("%d: result rejected: %s", pos, r.Err)
+		}
+		if i == 0 && h.sess.next != 0 {
+			t.Errorf("%d: committed before the files preceding it", pos)
+		}
+	}
+	if h.sess.next != uint64(len(order)) || len(h.sess.pending) > 0 {
+		t.Errorf("files committed: %d (%d pending)", h.sess.next, len(h.sess.pending))
+	}
+	if got := h.sess.digest.Global(); !bytes.Equal(got, want.Sum(nil)) {
+		t.Errorf("global digest %x, want %x", got, want.Sum(nil))
+	}
+	if cz := h.sess.cz; cz.Count != uint64(len(order)) || cz.Size != 10 {
+		t.Errorf("unexpected count/size: %d/%f", cz.Count, cz.Size)
+	}
+	if r := h.commit(1, validResult("1", 2, sums[1])); r.IsValid() {
+		t.Errorf("file committed twice")
+	}
+}
+
+func TestSynchronizeConnections(t *testing.T) {
+	var (
+		src = t.TempDir()
+		dst = t.TempDir()
+		rnd = rand.New(rand.NewSource(1))
+	)
+	for i := 0; i < 40; i++ {
+		data := make([]byte, 1+rnd.Intn(256<<10))
+		rnd.Read(data)
+		if err := os.WriteFile(filepath.Join(src, fmt.Sprintf("f%02d", i)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := serve(t, dst, nil, WithWorkers(4))
+	c, err := NewClient(addr, "sha256", WithConnections(4), WithPipeline(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, err := NewScanner("sha256", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	cz, err := s.Synchronize(c, src, "", true, false)
+	if err != nil {
+		t.Fatalf("synchronize: %s", err)
+	}
+	if cz.Count != 40 {
+		t.Errorf("%d files synchronized", cz.Count)
+	}
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		want, _ := os.ReadFile(filepath.Join(src, name))
+		got, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s: content mismatched (%v)", name, err)
+		}
+	}
+}
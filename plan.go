@@ -0,0 +1,104 @@
+package achile
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Plan collects the actions that a synchronization would perform on the
+// server instead of performing them. Like Progress, it writes a line per
+// action on w when w is a terminal and a stream of JSON objects otherwise.
+type Plan struct {
+	Copy      Coze
+	Overwrite Coze
+	Delete    Coze
+	Unchanged Coze
+
+	writer io.Writer
+	json   bool
+	mu     sync.Mutex
+}
+
+func NewPlan(w io.Writer) *Plan {
+	return &Plan{
+		writer: w,
+		json:   !isTerminal(w),
+	}
+}
+
+type planAction struct {
+	Action string `json:"action"`
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	Sum    string `json:"sum,omitempty"`
+}
+
+type planSummary struct {
+	Copy           uint64 `json:"copy"`
+	CopyBytes      int64  `json:"copy_bytes"`
+	Overwrite      uint64 `json:"overwrite"`
+	OverwriteBytes int64  `json:"overwrite_bytes"`
+	Delete         uint64 `json:"delete"`
+	DeleteBytes    int64  `json:"delete_bytes"`
+	Unchanged      uint64 `json:"unchanged"`
+	UnchangedBytes int64  `json:"unchanged_bytes"`
+	Done           bool   `json:"done"`
+}
+
+func (p *Plan) add(st byte, e Entry, sum []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	a := planAction{
+		File: remoteName(e.File),
+		Size: int64(e.Size),
+		Sum:  hex.EncodeToString(sum),
+	}
+	switch st {
+	case Added:
+		a.Action = "copy"
+		p.Copy.Update(e.Size)
+	case Modified:
+		a.Action = "overwrite"
+		p.Overwrite.Update(e.Size)
+	case Deleted:
+		a.Action = "delete"
+		p.Delete.Update(e.Size)
+	case Identical:
+		a.Action = "unchanged"
+		p.Unchanged.Update(e.Size)
+	}
+	if p.json {
+		json.NewEncoder(p.writer).Encode(a)
+	} else {
+		fmt.Fprintf(p.writer, "%c  %-12d  %s\n", st, a.Size, a.File)
+	}
+}
+
+// Flush writes the number of files affected by each action.
+func (p *Plan) Flush() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.json {
+		return json.NewEncoder(p.writer).Encode(planSummary{
+			Copy:           p.Copy.Count,
+			CopyBytes:      int64(p.Copy.Size),
+			Overwrite:      p.Overwrite.Count,
+			OverwriteBytes: int64(p.Overwrite.Size),
+			Delete:         p.Delete.Count,
+			DeleteBytes:    int64(p.Delete.Size),
+			Unchanged:      p.Unchanged.Count,
+			UnchangedBytes: int64(p.Unchanged.Size),
+			Done:           true,
+		})
+	}
+	_, err := fmt.Fprintf(p.writer, "%d files to copy (%s), %d to overwrite (%s), %d to delete (%s), %d unchanged (%s)\n",
+		p.Copy.Count, FormatSize(p.Copy.Size),
+		p.Overwrite.Count, FormatSize(p.Overwrite.Size),
+		p.Delete.Count, FormatSize(p.Delete.Size),
+		p.Unchanged.Count, FormatSize(p.Unchanged.Size))
+	return err
+}
@@ -0,0 +1,276 @@
+package achile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	textInterval = 500 * time.Millisecond
+	jsonInterval = time.Second
+)
+
+type Progress struct {
+	writer   io.Writer
+	json     bool
+	interval time.Duration
+
+	mu      sync.Mutex
+	total   Coze
+	files   uint64
+	bytes   float64
+	current float64
+	file    string
+	begin   time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewProgress creates a Progress that writes a status line on w when w is a
+// terminal and a stream of JSON objects, one per line, otherwise.
+func NewProgress(w io.Writer) *Progress {
+	p := Progress{
+		writer:   w,
+		json:     !isTerminal(w),
+		interval: textInterval,
+	}
+	if p.json {
+		p.interval = jsonInterval
+	}
+	return &p
+}
+
+func (p *Progress) Count(base, pattern string) error {
+	var (
+		fsys ArchiveFS
+		err  error
+	)
+	if IsArchive(base) {
+		if fsys, err = OpenArchive(base); err != nil {
+			return err
+		}
+		defer fsys.Close()
+		base = "."
+	}
+	var queue <-chan Entry
+	if fsys == nil {
+		queue, err = FetchFiles(base, pattern)
+	} else {
+		queue, err = FetchFilesFS(fsys, base, pattern)
+	}
+	if err != nil {
+		return err
+	}
+	var cz Coze
+	for e := range queue {
+		cz.Update(e.Size)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total.Merge(cz)
+	return nil
+}
+
+// CountList adds the files of a list created by the scan command to the
+// files to process.
+func (p *Progress) CountList(list string) error {
+	r, err := os.Open(list)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	buf := make([]byte, 16)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	d, err := NewDigest(string(bytes.Trim(buf, "\x00")))
+	if err != nil {
+		return err
+	}
+	var cz Coze
+	for i := range FetchInfos(bufio.NewReader(r), d.Size()) {
+		cz.Update(i.Size)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total.Merge(cz)
+	return nil
+}
+
+func (p *Progress) Start() {
+	p.mu.Lock()
+	p.begin = time.Now()
+	p.done = make(chan struct{})
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		tick := time.NewTicker(p.interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				p.render(false)
+			case <-p.done:
+				p.render(true)
+				return
+			}
+		}
+	}()
+}
+
+func (p *Progress) Stop() {
+	if p.done == nil {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+	p.done = nil
+}
+
+func (p *Progress) Write(bs []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current += float64(len(bs))
+	return len(bs), nil
+}
+
+func (p *Progress) update(file string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.file = file
+	p.current = 0
+}
+
+func (p *Progress) complete(z float64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.files++
+	p.bytes += z
+	p.current = 0
+}
+
+// add counts z bytes of the current file as done without being read.
+func (p *Progress) add(z float64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.bytes += z
+}
+
+// readerFrom returns a reader counting the bytes read from r as done. It
+// follows the bytes of a file sent to the server, since files are sent in
+// the background, possibly several at once.
+func (p *Progress) readerFrom(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return io.TeeReader(r, progressWriter{p})
+}
+
+type progressWriter struct {
+	p *Progress
+}
+
+func (w progressWriter) Write(bs []byte) (int, error) {
+	w.p.add(float64(len(bs)))
+	return len(bs), nil
+}
+
+type progressState struct {
+	Files      uint64  `json:"files"`
+	TotalFiles uint64  `json:"total_files"`
+	Bytes      int64   `json:"bytes"`
+	TotalBytes int64   `json:"total_bytes"`
+	Rate       float64 `json:"rate"`
+	Eta        float64 `json:"eta"`
+	Elapsed    float64 `json:"elapsed"`
+	File       string  `json:"file,omitempty"`
+	Done       bool    `json:"done,omitempty"`
+}
+
+func (p *Progress) state() progressState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var (
+		elapsed = time.Since(p.begin).Seconds()
+		bytes   = p.bytes + p.current
+		st      = progressState{
+			Files:      p.files,
+			TotalFiles: p.total.Count,
+			Bytes:      int64(bytes),
+			TotalBytes: int64(p.total.Size),
+			Elapsed:    elapsed,
+			File:       p.file,
+		}
+	)
+	if elapsed > 0 {
+		st.Rate = bytes / elapsed
+	}
+	if st.Rate > 0 && p.total.Size > bytes {
+		st.Eta = (p.total.Size - bytes) / st.Rate
+	}
+	return st
+}
+
+func (p *Progress) render(last bool) {
+	st := p.state()
+	st.Done = last
+	if p.json {
+		json.NewEncoder(p.writer).Encode(st)
+		return
+	}
+	var (
+		eta  = time.Duration(st.Eta) * time.Second
+		rate = st.Rate / (1 << 20)
+		line = fmt.Sprintf("%d/%d files  %s/%s  %.2fMB/s  ETA %s", st.Files, st.TotalFiles, FormatSize(float64(st.Bytes)), FormatSize(float64(st.TotalBytes)), rate, eta)
+	)
+	if !last && st.File != "" {
+		line = fmt.Sprintf("%s  %s", line, st.File)
+	}
+	const width = 120
+	if len(line) > width {
+		line = line[:width]
+	}
+	fmt.Fprintf(p.writer, "\r%s%s", line, strings.Repeat(" ", width-len(line)))
+	if last {
+		fmt.Fprintln(p.writer)
+	}
+}
+
+func (p *Progress) writerTo(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return io.MultiWriter(w, p)
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	i, err := f.Stat()
+	return err == nil && i.Mode()&os.ModeCharDevice != 0
+}
@@ -3,13 +3,19 @@ package achile
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"time"
 )
 
@@ -25,6 +31,14 @@ const (
 	ReqCheck byte = iota
 	ReqCopy
 	ReqCmp
+	ReqAuth
+	ReqPartial
+	ReqSignature
+	ReqDelta
+	ReqList
+	ReqFetch
+	ReqScan
+	ReqDelete
 )
 
 const (
@@ -33,248 +47,502 @@ const (
 	CodeSize
 	CodeNoent
 	CodeUnexpected
+	CodeDenied
+	CodePartial
+	CodeSignature
+	CodeData
+	CodeBusy
+	CodeForbidden
+	CodeAlg
 )
 
 const codeLen = 4 //binary.Size(CodeOk)
 
+type ClientOption func(*Client)
+
+func WithTLS(cfg *tls.Config) ClientOption {
+	return func(c *Client) {
+		c.tls = cfg
+	}
+}
+
 type Client struct {
 	conn    net.Conn
+	alg     string
 	hashlen int
+	caps    uint32
+	window  int
+
+	timeout     time.Duration
+	dialTimeout time.Duration
+
+	compress string
+	skip     map[string]struct{}
+	metadata bool
+
+	tls   *tls.Config
+	user  string
+	token string
+	share string
+
+	conns   int
+	session string
+	peers   []*Client
+	turn    uint32
+	seq     *sequence
+
+	progress *Progress
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	once sync.Once
+	jobs chan func()
+	quit chan struct{}
+
+	mu     sync.Mutex
+	id     uint32
+	calls  map[uint32]*call
+	broken error
 }
 
-func NewClient(addr, alg string) (*Client, error) {
-	c, err := net.Dial("tcp", addr)
-	if err != nil {
+func NewClient(addr, alg string, opts ...ClientOption) (*Client, error) {
+	client := Client{
+		alg:     alg,
+		window:  DefaultWindow,
+		timeout: DefaultTimeout,
+		conns:   1,
+		seq:     newSequence(),
+		calls:   make(map[uint32]*call),
+		quit:    make(chan struct{}),
+	}
+	addr, client.share = splitShare(addr)
+	for _, o := range opts {
+		o(&client)
+	}
+	var err error
+	if client.hashlen, err = SizeHash(alg); err != nil {
 		return nil, err
 	}
-	client := Client{conn: c}
-	if client.hashlen, err = SizeHash(alg); err != nil {
+	if client.conns > 1 {
+		if client.session, err = newSessionID(); err != nil {
+			return nil, err
+		}
+	}
+	if err := client.dial(addr); err != nil {
 		return nil, err
 	}
-	return &client, client.init(alg)
+	if err := client.dialPeers(addr); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &client, nil
 }
 
-func (c *Client) Compare(cz Coze, sum []byte) error {
-	var buf bytes.Buffer
-	binary.Write(&buf, binary.BigEndian, ReqCmp)
-	binary.Write(&buf, binary.BigEndian, cz.Count)
-	binary.Write(&buf, binary.BigEndian, cz.Size)
-	buf.Write(sum)
-	if _, err := io.Copy(c.conn, &buf); err != nil {
+func (c *Client) dial(addr string) error {
+	var (
+		dialer = net.Dialer{Timeout: c.dialTimeout}
+		err    error
+	)
+	if c.tls != nil {
+		c.conn, err = tls.DialWithDialer(&dialer, "tcp", addr, c.tls)
+	} else {
+		c.conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	c.w = bufio.NewWriter(c.conn)
+	if err := c.init(c.alg); err != nil {
+		c.Close()
 		return err
 	}
-	return c.err()
+	return nil
+}
+
+func (c *Client) Compare(cz Coze, sum []byte) error {
+	return c.roundTrip(ReqCmp, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, cz.Count)
+		binary.Write(w, binary.BigEndian, cz.Size)
+		_, err := w.Write(sum)
+		return err
+	})
 }
 
 func (c *Client) Copy(file string, e Entry, sum []byte) error {
-	r, err := os.Open(file)
+	cl, err := c.pick().copy(file, e, sum)
 	if err != nil {
 		return err
 	}
-	defer r.Close()
+	return c.result(cl)
+}
 
-	var (
-		buf bytes.Buffer
-		raw = []byte(e.File)
-	)
-	binary.Write(&buf, binary.BigEndian, ReqCopy)
-	binary.Write(&buf, binary.BigEndian, e.Size)
-	buf.Write(sum)
-	binary.Write(&buf, binary.BigEndian, uint16(len(raw)))
-	buf.Write(raw)
+func (c *Client) copy(file string, e Entry, sum []byte) (*call, error) {
+	r, err := openFile(e.fsys, file)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		r.Close()
+	}()
 
-	_, err = io.Copy(c.conn, io.MultiReader(&buf, r))
-	if err == nil {
-		err = c.err()
+	var offset int64
+	if c.caps&CapResume != 0 {
+		if offset, err = c.resume(r, e, sum); err != nil {
+			return nil, err
+		}
+		if offset == 0 {
+			r.Close()
+			if r, err = openFile(e.fsys, file); err != nil {
+				return nil, err
+			}
+		}
 	}
-	return err
-}
+	c.progress.add(float64(offset))
 
-func (c *Client) Check(e Entry, sum []byte) error {
 	var (
-		buf bytes.Buffer
-		raw = []byte(e.File)
+		raw      = []byte(remoteName(e.File))
+		compress = c.compressible(e.File)
 	)
-	binary.Write(&buf, binary.BigEndian, ReqCheck)
-	binary.Write(&buf, binary.BigEndian, e.Size)
-	buf.Write(sum)
-	binary.Write(&buf, binary.BigEndian, uint16(len(raw)))
-	buf.Write(raw)
-
-	_, err := io.Copy(c.conn, &buf)
-	if err == nil {
-		err = c.err()
-	}
-	return err
-}
-
-func (c *Client) Close() error {
-	return c.conn.Close()
+	return c.sendEntry(ReqCopy, e, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, e.Size)
+		w.Write(sum)
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		w.Write(raw)
+		binary.Write(w, binary.BigEndian, offset)
+		binary.Write(w, binary.BigEndian, compress)
+		c.writeMetadata(w, file, e)
+		body := c.progress.readerFrom(r)
+		if compress {
+			return compressTo(c.compress, w, body)
+		}
+		_, err := io.Copy(w, body)
+		return err
+	})
 }
 
-func (c *Client) init(alg string) error {
-	buf := make([]byte, 16)
-	copy(buf, alg)
-	if _, err := c.conn.Write(buf); err != nil {
+func (c *Client) Check(e Entry, sum []byte) error {
+	cl, err := c.pick().check(e, sum)
+	if err != nil {
 		return err
 	}
-	return c.err()
+	return c.result(cl)
 }
 
-func (c *Client) err() error {
-	c.conn.SetReadDeadline(time.Now().Add(time.Second))
-	buf := make([]byte, 1024)
-	n, err := c.conn.Read(buf)
-	if err != nil {
+func (c *Client) check(e Entry, sum []byte) (*call, error) {
+	raw := []byte(remoteName(e.File))
+	cl, err := c.sendEntry(ReqCheck, e, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, e.Size)
+		w.Write(sum)
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		_, err := w.Write(raw)
 		return err
+	})
+	if err == nil {
+		cl.timeout = c.hashTimeout(e.Size)
 	}
-	if n < codeLen {
-		return fmt.Errorf("response too short")
-	}
+	return cl, err
+}
 
-	readString := func(r io.Reader) string {
-		var (
-			raw  uint16
-			file []byte
-		)
-		binary.Read(r, binary.BigEndian, &raw)
-		file = make([]byte, raw)
-		io.ReadFull(r, file)
-		return string(file)
+func (c *Client) Close() error {
+	err := c.conn.Close()
+	c.shutdown(net.ErrClosed)
+	for _, p := range c.peers {
+		if e := p.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
+	return err
+}
 
+func (c *Client) decode(code uint32, body *bytes.Reader) error {
 	var (
-		code = binary.BigEndian.Uint32(buf)
-		body = bytes.NewReader(buf[codeLen:n])
+		d   = decoder{r: body}
+		err error
 	)
 	switch code {
 	case CodeOk:
-		return nil
+		d.int64()
+		d.field()
+		d.string()
 	case CodeSize:
 		var (
-			want int64
-			got  int64
-			file string
+			want = d.int64()
+			got  = d.int64()
+			file = d.string()
 		)
-		binary.Read(body, binary.BigEndian, &want)
-		binary.Read(body, binary.BigEndian, &got)
-		file = readString(body)
-		return fmt.Errorf("%w: invalid size %s (%d != %d)", ErrSize, file, want, got)
+		err = fmt.Errorf("%w: invalid size %s (%d != %d)", ErrSize, file, want, got)
 	case CodeDigest:
 		var (
-			want = make([]byte, c.hashlen)
-			got  = make([]byte, c.hashlen)
-			file string
+			want = d.bytes(c.hashlen)
+			got  = d.bytes(c.hashlen)
+			file = d.string()
 		)
-		io.ReadFull(body, want)
-		io.ReadFull(body, got)
-		file = readString(body)
-		return fmt.Errorf("%w: invalid digest %s (%x != %x)", ErrSum, file, want, got)
+		err = fmt.Errorf("%w: invalid digest %s (%x != %x)", ErrSum, file, want, got)
 	case CodeNoent:
-		file := readString(body)
-		return fmt.Errorf("%w: no such file on remote %s", ErrFile, file)
+		file := d.string()
+		err = fmt.Errorf("%w: no such file on remote %s", ErrFile, file)
 	case CodeUnexpected:
-		msg := make([]byte, body.Size())
-		io.ReadFull(body, msg)
-		return fmt.Errorf("unexpected error: %s", msg)
+		msg := d.string()
+		err = fmt.Errorf("unexpected error: %s", msg)
+	case CodeDenied:
+		msg := d.string()
+		err = fmt.Errorf("%w: %s", ErrDenied, msg)
+	case CodeBusy:
+		msg := d.string()
+		err = fmt.Errorf("%w: %s", ErrBusy, msg)
+	case CodeForbidden:
+		msg := d.string()
+		err = fmt.Errorf("%w: %s", ErrForbidden, msg)
+	case CodeAlg:
+		msg := d.string()
+		err = fmt.Errorf("%w: %s", ErrAlg, msg)
+	case CodePartial, CodeSignature, CodeData:
+		return fmt.Errorf("%w: unexpected response code %08x", ErrProtocol, code)
 	default:
-		return fmt.Errorf("unexpected error code %08x", code)
+		return fmt.Errorf("%w: unknown response code %08x", ErrProtocol, code)
 	}
+	if d.err != nil {
+		return fmt.Errorf("%w: truncated response (code %08x)", ErrProtocol, code)
+	}
+	return err
 }
 
+// decoder reads the fields of the body of a response. The first error is
+// kept and reported once all the fields have been read.
+type decoder struct {
+	r   io.Reader
+	err error
+}
+
+func (d *decoder) int64() int64 {
+	var v int64
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.BigEndian, &v)
+	}
+	return v
+}
+
+func (d *decoder) bytes(n int) []byte {
+	buf := make([]byte, n)
+	if d.err == nil {
+		_, d.err = io.ReadFull(d.r, buf)
+	}
+	return buf
+}
+
+func (d *decoder) field() []byte {
+	var z uint16
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.BigEndian, &z)
+	}
+	return d.bytes(int(z))
+}
+
+func (d *decoder) string() string {
+	return string(d.field())
+}
+
+type HandlerOption func(*Handler)
+
 type Handler struct {
 	conn   net.Conn
+	alg    string
 	digest *Digest
 	base   string
 	cz     Coze
+	caps   uint32
+
+	compress string
+
+	users  map[string]string
+	user   string
+	nonce  []byte
+	authed bool
+	shares map[string]Share
+	mode   Mode
+
+	idle     time.Duration
+	lifetime time.Duration
+	started  time.Time
+	smu      sync.Mutex
+	waiting  bool
+	stopped  bool
+	running  int
+
+	umask    fs.FileMode
+	uid      int
+	gid      int
+	trash    string
+	preserve Preserve
+
+	workers int
+	sema    chan struct{}
+	wg      sync.WaitGroup
+	wmu     sync.Mutex
+
+	sess *session
 }
 
-func NewHandler(conn net.Conn, base string) (*Handler, error) {
+func NewHandler(conn net.Conn, base string, opts ...HandlerOption) (*Handler, error) {
 	h := Handler{
-		conn: conn,
-		base: base,
-	}
+		conn:    conn,
+		base:    base,
+		umask:   DefaultUmask,
+		uid:     -1,
+		gid:     -1,
+		workers: runtime.NumCPU(),
+	}
+	for _, o := range opts {
+		o(&h)
+	}
+	if h.workers <= 0 {
+		h.workers = 1
+	}
+	h.sema = make(chan struct{}, h.workers)
+	h.started = time.Now()
+	conn.SetDeadline(h.deadline())
 	return &h, h.init()
 }
 
 func (h *Handler) Handle() {
 	defer h.conn.Close()
+	defer h.sess.leave()
+	defer h.wg.Wait()
 
-	rs := bufio.NewReader(h.conn)
+	rs := bufio.NewReader(deadlineReader{h: h})
 	for {
-		req, err := rs.ReadByte()
-		if err != nil {
+		var (
+			req byte
+			id  uint32
+			pos uint64
+		)
+		if !h.await(true) {
+			return
+		}
+		if err := binary.Read(rs, binary.BigEndian, &req); err != nil {
+			return
+		}
+		h.await(false)
+		if err := binary.Read(rs, binary.BigEndian, &id); err != nil {
 			return
 		}
-		h.digest.Reset()
+		if !h.authed && req != ReqAuth {
+			h.reply(id, deniedResult(fmt.Errorf("authentication required")))
+			return
+		}
+		if req == ReqCheck || req == ReqCopy || req == ReqDelta || req == ReqFetch {
+			if err := binary.Read(rs, binary.BigEndian, &pos); err != nil {
+				return
+			}
+		}
+		d := h.newDigest()
 
 		var r *Result
 		switch req {
+		case ReqAuth:
+			r = h.handleAuth(rs)
 		case ReqCheck:
-			r = h.handleCheck(rs)
+			dat, err := h.readCheck(rs)
+			if err != nil {
+				h.reply(id, unhandledResult(err))
+				return
+			}
+			h.sema <- struct{}{}
+			h.wg.Add(1)
+			h.track(1)
+			go func() {
+				defer func() {
+					h.track(-1)
+					<-h.sema
+					h.wg.Done()
+				}()
+				h.reply(id, h.commit(pos, h.handleCheck(dat, d)))
+			}()
+			continue
 		case ReqCopy:
-			r = h.handleCopy(rs)
+			r = h.commit(pos, h.handleCopy(rs, d))
+		case ReqDelta:
+			r = h.commit(pos, h.handleDelta(rs, d))
 		case ReqCmp:
+			h.wg.Wait()
 			r = h.handleCompare(rs)
+		case ReqPartial:
+			r = h.handlePartial(rs)
+		case ReqSignature:
+			r = h.handleSignature(rs)
+		case ReqList:
+			r = h.handleList(id, rs)
+		case ReqFetch:
+			r = h.commit(pos, h.handleFetch(id, rs, d))
+		case ReqScan:
+			r = h.handleScan(id, rs)
+		case ReqDelete:
+			r = h.handleDelete(rs)
 		default:
 			r = unhandledResult(fmt.Errorf("unsupported request"))
 		}
-		if r.IsValid() {
-			h.cz.Update(float64(r.Size.Got))
-		}
-		if err := h.reply(r); err != nil {
+		if err := h.reply(id, r); err != nil || (req == ReqAuth && !h.authed) {
 			return
 		}
 	}
 }
 
-func (h *Handler) handleCheck(rs io.Reader) *Result {
-	dat := struct {
-		Size float64
-		Sum  []byte
-		Raw  uint16
-		File []byte
-	}{}
+type checkRequest struct {
+	Size float64
+	Sum  []byte
+	Raw  uint16
+	File []byte
+}
 
+func (h *Handler) readCheck(rs io.Reader) (checkRequest, error) {
+	var dat checkRequest
 	binary.Read(rs, binary.BigEndian, &dat.Size)
 	dat.Sum = make([]byte, h.digest.Size())
 	if _, err := io.ReadFull(rs, dat.Sum); err != nil {
-		return unhandledResult(err)
+		return dat, err
 	}
 	binary.Read(rs, binary.BigEndian, &dat.Raw)
 	dat.File = make([]byte, dat.Raw)
-	if _, err := io.ReadFull(rs, dat.File); err != nil {
-		return unhandledResult(err)
-	}
+	_, err := io.ReadFull(rs, dat.File)
+	return dat, err
+}
 
-	r, err := os.Open(filepath.Join(h.base, string(dat.File)))
+func (h *Handler) handleCheck(dat checkRequest, d *Digest) *Result {
+	file, err := h.resolve(string(dat.File))
+	if err != nil {
+		return deniedResult(err)
+	}
+	r, err := os.Open(file)
 	if err != nil {
 		return nosuchFileResult(string(dat.File))
 	}
 	defer r.Close()
 
-	n, err := io.Copy(h.digest, r)
+	n, err := io.Copy(d, r)
 	if err != nil {
 		return unhandledResult(err)
 	}
 	if n != int64(dat.Size) {
 		return sizeMismatchResult(string(dat.File), int64(dat.Size), n)
 	}
-	if sum := h.digest.Local(); !bytes.Equal(dat.Sum, sum) {
+	if sum := d.Local(); !bytes.Equal(dat.Sum, sum) {
 		return checksumMismatchResult(string(dat.File), dat.Sum, sum)
 	}
 	return validResult(string(dat.File), int64(dat.Size), dat.Sum)
 }
 
-func (h *Handler) handleCopy(rs io.Reader) *Result {
+func (h *Handler) handleCopy(rs io.Reader, d *Digest) *Result {
 	dat := struct {
-		Size float64
-		Sum  []byte
-		Raw  uint16
-		File []byte
+		Size     float64
+		Sum      []byte
+		Raw      uint16
+		File     []byte
+		Offset   int64
+		Compress bool
 	}{}
 
-	dat.Sum = make([]byte, h.digest.Size())
+	dat.Sum = make([]byte, d.Size())
 	binary.Read(rs, binary.BigEndian, &dat.Size)
 	if _, err := io.ReadFull(rs, dat.Sum); err != nil {
 		return unhandledResult(err)
@@ -284,27 +552,93 @@ func (h *Handler) handleCopy(rs io.Reader) *Result {
 	if _, err := io.ReadFull(rs, dat.File); err != nil {
 		return unhandledResult(err)
 	}
-
-	file := filepath.Join(h.base, string(dat.File))
-	if err := os.MkdirAll(filepath.Dir(file), 0x755); err != nil {
+	binary.Read(rs, binary.BigEndian, &dat.Offset)
+	if err := binary.Read(rs, binary.BigEndian, &dat.Compress); err != nil {
 		return unhandledResult(err)
 	}
-	w, err := os.Create(file)
+	meta, err := h.readMetadata(rs)
 	if err != nil {
 		return unhandledResult(err)
 	}
-	defer w.Close()
 
-	n, err := io.CopyN(io.MultiWriter(w, h.digest), rs, int64(dat.Size))
+	var (
+		body    = rs
+		remain  = int64(dat.Size) - dat.Offset
+		discard = func(r *Result) *Result {
+			io.CopyN(ioutil.Discard, rs, remain)
+			return r
+		}
+	)
+	if dat.Compress {
+		cr := &chunkReader{r: rs}
+		defer io.Copy(ioutil.Discard, cr)
+		discard = func(r *Result) *Result {
+			return r
+		}
+		if h.compress == "" {
+			return unhandledResult(fmt.Errorf("compression not negotiated"))
+		}
+		zr, err := compressReader(h.compress, cr)
+		if err != nil {
+			return unhandledResult(err)
+		}
+		body = zr
+	}
+	if dat.Offset < 0 || dat.Offset > int64(dat.Size) {
+		return discard(unhandledResult(fmt.Errorf("invalid offset %d", dat.Offset)))
+	}
+	file, err := h.writable(string(dat.File))
+	if err != nil {
+		return discard(deniedResult(err))
+	}
+	if err := h.mkdirAll(filepath.Dir(file)); err != nil {
+		return discard(unhandledResult(err))
+	}
+	w, release, err := h.openPartial(file, dat.Offset)
+	if err != nil {
+		return discard(unhandledResult(err))
+	}
+	keep := false
+	defer func() {
+		w.Close()
+		if !keep {
+			os.Remove(w.Name())
+		}
+		release()
+	}()
+	if dat.Offset > 0 {
+		if _, err := io.Copy(d, io.NewSectionReader(w, 0, dat.Offset)); err != nil {
+			return discard(unhandledResult(err))
+		}
+	}
+
+	// the content not copied when writing the file fails has still to be
+	// read: it would otherwise be taken for the next requests.
+	lr := &io.LimitedReader{R: body, N: remain}
+	n, err := io.CopyN(io.MultiWriter(w, d), lr, remain)
 	if err != nil {
+		io.Copy(ioutil.Discard, lr)
+		keep = isPartial(w.Name()) && w.Sync() == nil
 		return unhandledResult(err)
 	}
-	if n != int64(dat.Size) {
-		return sizeMismatchResult(string(dat.File), int64(dat.Size), n)
+	if n != remain {
+		return sizeMismatchResult(string(dat.File), int64(dat.Size), dat.Offset+n)
 	}
-	if sum := h.digest.Local(); !bytes.Equal(dat.Sum, sum) {
+	if sum := d.Local(); !bytes.Equal(dat.Sum, sum) {
 		return checksumMismatchResult(string(dat.File), dat.Sum, sum)
 	}
+	if err := w.Sync(); err != nil {
+		return unhandledResult(err)
+	}
+	if err := w.Close(); err != nil {
+		return unhandledResult(err)
+	}
+	if err := h.applyMetadata(w.Name(), meta); err != nil {
+		return unhandledResult(err)
+	}
+	if err := os.Rename(w.Name(), file); err != nil {
+		return unhandledResult(err)
+	}
 	return validResult(string(dat.File), int64(dat.Size), dat.Sum)
 }
 
@@ -317,59 +651,37 @@ func (h *Handler) handleCompare(rs io.Reader) *Result {
 		return unhandledResult(err)
 	}
 
-	if !h.cz.Equal(z) {
+	h.sess.mu.Lock()
+	defer h.sess.mu.Unlock()
+	if len(h.sess.pending) > 0 {
+		return unhandledResult(fmt.Errorf("%w: %d file(s) received out of sequence", ErrMismatch, len(h.sess.pending)))
+	}
+	if !h.sess.cz.Equal(z) {
 		return unhandledResult(ErrMismatch)
 	}
-	if gsum := h.digest.Global(); !bytes.Equal(sum, gsum) {
+	if gsum := h.sess.digest.Global(); !bytes.Equal(sum, gsum) {
 		return checksumMismatchResult("", sum, gsum)
 	}
 
 	return validResult("", int64(z.Size), sum)
 }
 
-func (h *Handler) reply(r *Result) error {
+func (h *Handler) reply(id uint32, r *Result) error {
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
 	var buf bytes.Buffer
-	switch r.Err {
-	case nil:
-		r.writeOk(&buf)
-	case ErrSize:
-		r.writeBadSize(&buf)
-	case ErrSum:
-		r.writeBadSum(&buf)
-	case ErrFile:
-		r.writeBadFile(&buf)
-	default:
-		r.writeUnexpected(&buf)
-	}
+	writeFrame(&buf, id, r)
+	h.conn.SetWriteDeadline(h.deadline())
 	_, err := io.Copy(h.conn, &buf)
 	return err
 }
 
-func (h *Handler) init() error {
-	buf := make([]byte, 16)
-	n, err := io.ReadFull(h.conn, buf)
-	if err != nil {
-		return err
-	}
-	h.digest, err = NewDigest(string(bytes.Trim(buf[:n], "\x00")))
-
-	r := emptyResult()
-	if err != nil {
-		r = unhandledResult(ErrAlg)
-	}
-
-	if err1 := h.reply(r); err != nil || err1 != nil {
-		if err1 != nil {
-			err = err1
-		}
-		return err
-	}
-	return nil
-}
-
 type Result struct {
-	File []byte
-	Err  error
+	File   []byte
+	Err    error
+	Msg    string
+	Offset int64
+	Sig    *signature
 
 	Size struct {
 		Want int64
@@ -390,10 +702,37 @@ func (r Result) IsValid() bool {
 	return r.Err == nil
 }
 
+func (r Result) writeTo(w io.Writer) {
+	switch r.Err {
+	case nil:
+		r.writeOk(w)
+	case ErrSize:
+		r.writeBadSize(w)
+	case ErrSum:
+		r.writeBadSum(w)
+	case ErrFile:
+		r.writeBadFile(w)
+	case ErrDenied:
+		r.writeDenied(w)
+	case ErrBusy:
+		r.writeBusy(w)
+	case ErrForbidden:
+		r.writeForbidden(w)
+	case ErrAlg:
+		r.writeAlg(w)
+	case errPartial:
+		r.writePartial(w)
+	case errSignature:
+		r.writeSignature(w)
+	default:
+		r.writeUnexpected(w)
+	}
+}
+
 func (r Result) writeOk(w io.Writer) {
 	binary.Write(w, binary.BigEndian, CodeOk)
 	binary.Write(w, binary.BigEndian, r.Size.Got)
-	w.Write(r.Sum.Got)
+	writeField(w, r.Sum.Got)
 	r.writeFile(w)
 }
 
@@ -418,13 +757,27 @@ func (r Result) writeBadFile(w io.Writer) {
 
 func (r Result) writeUnexpected(w io.Writer) {
 	binary.Write(w, binary.BigEndian, CodeUnexpected)
-	io.WriteString(w, r.Err.Error())
+	r.File = []byte(r.Err.Error())
+	r.writeFile(w)
+}
+
+func (r Result) writeDenied(w io.Writer) {
+	binary.Write(w, binary.BigEndian, CodeDenied)
+	r.File = []byte(r.Msg)
+	r.writeFile(w)
 }
 
 func (r Result) writeFile(w io.Writer) {
-	binary.Write(w, binary.BigEndian, uint16(len(r.File)))
-	if len(r.File) > 0 {
-		w.Write(r.File)
+	writeField(w, r.File)
+}
+
+func writeField(w io.Writer, bs []byte) {
+	if len(bs) > math.MaxUint16 {
+		bs = bs[:math.MaxUint16]
+	}
+	binary.Write(w, binary.BigEndian, uint16(len(bs)))
+	if len(bs) > 0 {
+		w.Write(bs)
 	}
 }
 
@@ -445,6 +798,17 @@ func unhandledResult(err error) *Result {
 	return &Result{Err: err}
 }
 
+func deniedResult(err error) *Result {
+	r := Result{
+		Err: ErrDenied,
+		Msg: err.Error(),
+	}
+	if errors.Is(err, ErrForbidden) {
+		r.Err = ErrForbidden
+	}
+	return &r
+}
+
 func nosuchFileResult(file string) *Result {
 	return &Result{
 		File: []byte(file),
@@ -0,0 +1,146 @@
+package achile
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type failWriter struct{}
+
+func (failWriter) Write(bs []byte) (int, error) {
+	return 0, errors.New("no space left on device")
+}
+
+func TestCopyWriteFailure(t *testing.T) {
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "other"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		data  = bytes.Repeat([]byte{ReqDelete}, 64<<10)
+		sum   = sha256.Sum256(data)
+		other = sha256.Sum256([]byte("other"))
+		buf   bytes.Buffer
+	)
+	writeName := func(name string) {
+		binary.Write(&buf, binary.BigEndian, uint16(len(name)))
+		buf.WriteString(name)
+	}
+	binary.Write(&buf, binary.BigEndian, float64(len(data)))
+	buf.Write(sum[:])
+	writeName("file")
+	binary.Write(&buf, binary.BigEndian, int64(0))
+	binary.Write(&buf, binary.BigEndian, false)
+	buf.Write(data)
+
+	binary.Write(&buf, binary.BigEndian, ReqCheck)
+	binary.Write(&buf, binary.BigEndian, float64(5))
+	buf.Write(other[:])
+	writeName("other")
+
+	h := Handler{
+		base:  base,
+		alg:   "sha256",
+		umask: DefaultUmask,
+		uid:   -1,
+		gid:   -1,
+	}
+	h.digest, _ = NewDigest(h.alg)
+	d, _ := NewDigest(h.alg)
+	d.Writer = failWriter{}
+
+	rs := bufio.NewReader(&buf)
+	if r := h.handleCopy(rs, d); r.IsValid() {
+		t.Fatalf("copy succeeded while writing failed")
+	}
+	if _, err := os.Stat(filepath.Join(base, "file")); err == nil {
+		t.Errorf("file created while writing failed")
+	}
+	req, err := rs.ReadByte()
+	if err != nil || req != ReqCheck {
+		t.Fatalf("next request not found after failed copy (%02x, %v)", req, err)
+	}
+	dat, err := h.readCheck(rs)
+	if err != nil {
+		t.Fatalf("check: %s", err)
+	}
+	if d, _ = NewDigest(h.alg); !h.handleCheck(dat, d).IsValid() {
+		t.Errorf("check of %s failed", dat.File)
+	}
+}
+
+type slowConn struct {
+	net.Conn
+	delay *int64
+}
+
+func (c slowConn) Write(bs []byte) (int, error) {
+	time.Sleep(time.Duration(atomic.LoadInt64(c.delay)))
+	return c.Conn.Write(bs)
+}
+
+func TestCheckSlowHandler(t *testing.T) {
+	var (
+		base  = t.TempDir()
+		data  = make([]byte, 4*minHashRate)
+		sum   = sha256.Sum256(data)
+		delay int64
+	)
+	if err := os.WriteFile(filepath.Join(base, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, base, func(c net.Conn) net.Conn {
+		return slowConn{Conn: c, delay: &delay}
+	})
+	c, err := NewClient(addr, "sha256", WithTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	atomic.StoreInt64(&delay, int64(time.Second))
+	if err := c.Check(Entry{File: "file", Size: float64(len(data))}, sum[:]); err != nil {
+		t.Errorf("check: %s", err)
+	}
+}
+
+// serve accepts connections on a local address and handles them with a
+// Handler sharing base. wrap, when not nil, wraps the server side of each
+// connection.
+func serve(t *testing.T, base string, wrap func(net.Conn) net.Conn, opts ...HandlerOption) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if wrap != nil {
+				c = wrap(c)
+			}
+			go func() {
+				h, err := NewHandler(c, base, opts...)
+				if err != nil {
+					c.Close()
+					return
+				}
+				h.Handle()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
@@ -0,0 +1,376 @@
+package achile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// keepaliveInterval is the delay between the empty data frames sent while the
+// server computes the content of a response.
+const keepaliveInterval = 30 * time.Second
+
+// List returns the files found on the server that match pattern. An empty
+// pattern lists all the files of the server.
+func (c *Client) List(pattern string) ([]Entry, error) {
+	raw := []byte(pattern)
+	cl, err := c.send(ReqList, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		_, err := w.Write(raw)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var (
+		rs   = bufio.NewReader(c.stream(cl, c.timeout))
+		list []Entry
+	)
+	for {
+		var e Entry
+		if err = binary.Read(rs, binary.BigEndian, &e.Size); err != nil {
+			break
+		}
+		d := decoder{r: rs}
+		if e.File = d.string(); d.err != nil {
+			err = d.err
+			break
+		}
+		list = append(list, e)
+	}
+	io.Copy(ioutil.Discard, rs)
+
+	code, body, werr := c.wait(cl, c.timeout)
+	if werr != nil {
+		return nil, werr
+	}
+	if code != CodeOk {
+		return nil, c.decode(code, body)
+	}
+	if err != io.EOF {
+		return nil, fmt.Errorf("%w: invalid list (%s)", ErrProtocol, err)
+	}
+	d := decoder{r: body}
+	if n := d.int64(); d.err != nil || n != int64(len(list)) {
+		return nil, fmt.Errorf("%w: %d files listed, %d received", ErrProtocol, n, len(list))
+	}
+	return list, nil
+}
+
+// Fetch downloads the content of a file of the server into w. It returns the
+// checksum of the content computed by the server.
+func (c *Client) Fetch(e Entry, w io.Writer) ([]byte, error) {
+	raw := []byte(remoteName(e.File))
+	cl, err := c.sendEntry(ReqFetch, e, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, uint16(len(raw)))
+		_, err := w.Write(raw)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	rs := c.stream(cl, c.timeout)
+	n, err := io.Copy(w, rs)
+	if err != nil {
+		io.Copy(ioutil.Discard, rs)
+	}
+
+	code, body, werr := c.wait(cl, c.timeout)
+	if werr != nil {
+		return nil, werr
+	}
+	if code != CodeOk {
+		return nil, c.decode(code, body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var (
+		d    = decoder{r: body}
+		size = d.int64()
+		sum  = d.field()
+	)
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: truncated response (code %08x)", ErrProtocol, code)
+	}
+	if n != size {
+		return nil, fmt.Errorf("%w: invalid size %s (%d != %d)", ErrSize, raw, size, n)
+	}
+	return sum, nil
+}
+
+// Scan asks the server to scan the files of dir matching pattern and writes
+// the list of the files found, in the format of the lists created by the
+// scan command, to w.
+func (c *Client) Scan(dir, pattern string, w io.Writer) error {
+	var (
+		rawd = []byte(dir)
+		rawp = []byte(pattern)
+	)
+	cl, err := c.send(ReqScan, func(w io.Writer) error {
+		binary.Write(w, binary.BigEndian, uint16(len(rawd)))
+		w.Write(rawd)
+		binary.Write(w, binary.BigEndian, uint16(len(rawp)))
+		_, err := w.Write(rawp)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	timeout := signatureTimeout
+	if c.timeout > timeout {
+		timeout = c.timeout
+	}
+	rs := c.stream(cl, timeout)
+	if _, err = io.Copy(w, rs); err != nil {
+		io.Copy(ioutil.Discard, rs)
+	}
+
+	code, body, werr := c.wait(cl, c.timeout)
+	if werr != nil {
+		return werr
+	}
+	if code != CodeOk {
+		return c.decode(code, body)
+	}
+	return err
+}
+
+// stream returns a reader of the content sent by the server in the data
+// frames of the response to a request.
+func (c *Client) stream(cl *call, timeout time.Duration) io.Reader {
+	return &stream{
+		call:    cl,
+		timeout: timeout,
+	}
+}
+
+type stream struct {
+	call    *call
+	timeout time.Duration
+	buf     []byte
+}
+
+func (s *stream) Read(bs []byte) (int, error) {
+	var (
+		cl = s.call
+		c  = cl.client
+	)
+	for len(s.buf) == 0 {
+		t := time.NewTimer(s.timeout)
+		select {
+		case s.buf = <-cl.data:
+			t.Stop()
+		case <-cl.done:
+			t.Stop()
+			return 0, io.EOF
+		case <-t.C:
+			err := fmt.Errorf("no response from server after %s", s.timeout)
+			c.shutdown(err)
+			return 0, err
+		}
+	}
+	n := copy(bs, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// dataWriter sends what is written to it in the data frames of the response
+// to the request id.
+type dataWriter struct {
+	h  *Handler
+	id uint32
+}
+
+func (w dataWriter) Write(bs []byte) (int, error) {
+	w.h.wmu.Lock()
+	defer w.h.wmu.Unlock()
+
+	var n int
+	for len(bs) > 0 {
+		chunk := bs
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		if err := w.frame(chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		bs = bs[len(chunk):]
+	}
+	return n, nil
+}
+
+func (w dataWriter) frame(chunk []byte) error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, w.id)
+	binary.Write(&buf, binary.BigEndian, uint32(codeLen+len(chunk)))
+	binary.Write(&buf, binary.BigEndian, CodeData)
+	buf.Write(chunk)
+	w.h.conn.SetWriteDeadline(w.h.deadline())
+	_, err := io.Copy(w.h.conn, &buf)
+	return err
+}
+
+// keepalive sends an empty data frame every interval until the function
+// returned is called, so that the client keeps waiting for the content of a
+// response that takes time to be computed.
+func (w dataWriter) keepalive(interval time.Duration) func() {
+	var (
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				w.h.wmu.Lock()
+				err := w.frame(nil)
+				w.h.wmu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func (h *Handler) handleList(id uint32, rs io.Reader) *Result {
+	var raw uint16
+	binary.Read(rs, binary.BigEndian, &raw)
+	pattern := make([]byte, raw)
+	if _, err := io.ReadFull(rs, pattern); err != nil {
+		return unhandledResult(err)
+	}
+	if err := h.allow(ReqList); err != nil {
+		return deniedResult(err)
+	}
+	if len(pattern) > 0 {
+		if err := validName(string(pattern)); err != nil {
+			return deniedResult(err)
+		}
+	}
+	base := filepath.Clean(h.base)
+	queue, err := fetchFiles(base, string(pattern), true)
+	if err != nil {
+		return unhandledResult(err)
+	}
+	var (
+		w = bufio.NewWriterSize(dataWriter{h: h, id: id}, chunkSize)
+		n int64
+	)
+	for e := range queue {
+		name := remoteName(relativePath(nil, e.File, base))
+		if h.hidden(e.File) {
+			continue
+		}
+		if _, err := h.resolve(name); err != nil {
+			continue
+		}
+		binary.Write(w, binary.BigEndian, e.Size)
+		writeField(w, []byte(name))
+		n++
+	}
+	if err := w.Flush(); err != nil {
+		return unhandledResult(err)
+	}
+	return validResult("", n, nil)
+}
+
+func (h *Handler) handleFetch(id uint32, rs io.Reader, d *Digest) *Result {
+	var raw uint16
+	binary.Read(rs, binary.BigEndian, &raw)
+	name := make([]byte, raw)
+	if _, err := io.ReadFull(rs, name); err != nil {
+		return unhandledResult(err)
+	}
+	if err := h.allow(ReqFetch); err != nil {
+		return deniedResult(err)
+	}
+	file, err := h.resolve(string(name))
+	if err != nil {
+		return deniedResult(err)
+	}
+	if h.hidden(file) {
+		return nosuchFileResult(string(name))
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		return nosuchFileResult(string(name))
+	}
+	defer r.Close()
+
+	w := bufio.NewWriterSize(dataWriter{h: h, id: id}, chunkSize)
+	n, err := io.Copy(io.MultiWriter(w, d), r)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return unhandledResult(err)
+	}
+	return validResult(string(name), n, d.Local())
+}
+
+func (h *Handler) handleScan(id uint32, rs io.Reader) *Result {
+	d := decoder{r: rs}
+	var (
+		dir     = d.string()
+		pattern = d.string()
+	)
+	if d.err != nil {
+		return unhandledResult(d.err)
+	}
+	if err := h.allow(ReqScan); err != nil {
+		return deniedResult(err)
+	}
+	base := filepath.Clean(h.base)
+	if dir != "" && dir != "." {
+		file, err := h.resolve(dir)
+		if err != nil {
+			return deniedResult(err)
+		}
+		base = file
+	}
+	if pattern != "" {
+		if err := validName(pattern); err != nil {
+			return deniedResult(err)
+		}
+	}
+	w := dataWriter{h: h, id: id}
+	s, err := newScannerTo(h.alg, w)
+	if err != nil {
+		return unhandledResult(err)
+	}
+	stop := w.keepalive(keepaliveInterval)
+	defer stop()
+
+	s.filter = func(file string) bool {
+		if h.hidden(file) {
+			return false
+		}
+		_, err := h.resolve(remoteName(relativePath(nil, file, filepath.Clean(h.base))))
+		return err == nil
+	}
+	cz, err := s.Scan(base, pattern)
+	if err != nil {
+		return unhandledResult(err)
+	}
+	return validResult(dir, int64(cz.Count), s.Checksum())
+}
@@ -0,0 +1,73 @@
+package achile
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestFetchEmptyFiles(t *testing.T) {
+	var (
+		remote = t.TempDir()
+		local  = t.TempDir()
+		files  = map[string]string{
+			"a":       "content of a",
+			"empty":   "",
+			"d/empty": "",
+		}
+	)
+	for name, content := range files {
+		file := filepath.Join(remote, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := serve(t, remote, nil)
+	c, err := NewClient(addr, "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, err := NewScanner("sha256", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Fetch(c, local, "", false); err != nil {
+		t.Fatalf("fetch: %s", err)
+	}
+	for name, content := range files {
+		got, err := os.ReadFile(filepath.Join(local, filepath.FromSlash(name)))
+		if err != nil || string(got) != content {
+			t.Errorf("%s: file not fetched (%v)", name, err)
+		}
+	}
+
+	for _, name := range []string{"empty", "d/empty"} {
+		if err := os.Remove(filepath.Join(local, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := s.Prune(c, local, "", -1, false)
+	if err != nil {
+		t.Fatalf("prune: %s", err)
+	}
+	var pruned []string
+	for _, e := range list {
+		pruned = append(pruned, e.File)
+	}
+	sort.Strings(pruned)
+	if len(pruned) != 2 || pruned[0] != "d/empty" || pruned[1] != "empty" {
+		t.Errorf("files pruned: %q", pruned)
+	}
+	for _, name := range pruned {
+		if _, err := os.Stat(filepath.Join(remote, filepath.FromSlash(name))); err == nil {
+			t.Errorf("%s: file not deleted", name)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package achile
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const checkpointInterval = 5 * time.Second
+
+type scanResult struct {
+	Base    string
+	Pattern string
+	Coze    Coze
+}
+
+type checkpoint struct {
+	Alg    string
+	Offset int64
+	State  []byte
+	Done   []scanResult
+
+	Base    string
+	Pattern string
+	Count   int
+	Last    string
+	Coze    Coze
+}
+
+func checkpointFile(list string) string {
+	return list + ".resume"
+}
+
+func loadCheckpoint(file, alg string) (*checkpoint, error) {
+	r, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var c checkpoint
+	if err := gob.NewDecoder(r).Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: invalid checkpoint (%w)", file, err)
+	}
+	if !strings.EqualFold(c.Alg, alg) {
+		return nil, fmt.Errorf("%s: checkpoint created with %s", file, c.Alg)
+	}
+	return &c, nil
+}
+
+func (c *checkpoint) reopen(list string, dgt *Digest) (*os.File, error) {
+	if err := dgt.Restore(c.State); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(list, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(c.Offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(c.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (c *checkpoint) begin(base, pattern string) {
+	if c == nil {
+		return
+	}
+	c.Base, c.Pattern = base, pattern
+	c.Count, c.Last, c.Coze = 0, "", Coze{}
+}
+
+// restore takes back the files of the current directory already scanned
+// before the scan was interrupted.
+func (c *checkpoint) restore(count int, last string, cz Coze) {
+	if c == nil {
+		return
+	}
+	c.Count, c.Last, c.Coze = count, last, cz
+}
+
+func (c *checkpoint) update(file string, size float64) {
+	if c == nil {
+		return
+	}
+	c.Count++
+	c.Last = file
+	c.Coze.Update(size)
+}
+
+func (c *checkpoint) end(cz Coze) {
+	if c == nil {
+		return
+	}
+	r := scanResult{
+		Base:    c.Base,
+		Pattern: c.Pattern,
+		Coze:    cz,
+	}
+	c.Done = append(c.Done, r)
+	c.begin("", "")
+}
+
+func (s *Scanner) resumeDirectory(base, pattern string) (Coze, int, string, error) {
+	var (
+		cz Coze
+		rs = s.resume
+	)
+	if rs == nil {
+		return cz, 0, "", nil
+	}
+	if n := len(s.state.Done); n < len(rs.Done) {
+		r := rs.Done[n]
+		if r.Base != base || r.Pattern != pattern {
+			return cz, 0, "", fmt.Errorf("%s: can not resume scan (%s expected)", base, r.Base)
+		}
+		s.state.Done = append(s.state.Done, r)
+		return r.Coze, -1, "", nil
+	}
+	s.resume = nil
+	if rs.Base == "" {
+		return cz, 0, "", nil
+	}
+	if rs.Base != base || rs.Pattern != pattern {
+		return cz, 0, "", fmt.Errorf("%s: can not resume scan (%s expected)", base, rs.Base)
+	}
+	return rs.Coze, rs.Count, rs.Last, nil
+}
+
+func (s *Scanner) checkpoint(force bool) error {
+	if s.state == nil || (!force && time.Since(s.saved) < checkpointInterval) {
+		return nil
+	}
+	if err := s.inner.Flush(); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	var err error
+	if s.state.Offset, err = s.file.Seek(0, io.SeekCurrent); err != nil {
+		return err
+	}
+	if s.state.State, err = s.digest.State(); err != nil {
+		return err
+	}
+
+	file := checkpointFile(s.list)
+	w, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(w.Name())
+
+	if err := gob.NewEncoder(w).Encode(s.state); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	s.saved = time.Now()
+	return os.Rename(w.Name(), file)
+}
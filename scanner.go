@@ -2,55 +2,125 @@ package achile
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 )
 
 type Scanner struct {
 	closer io.Closer
 	inner  *bufio.Writer
+	file   *os.File
+	list   string
+
+	state  *checkpoint
+	resume *checkpoint
+	saved  time.Time
+	failed bool
 
 	verbose bool
 	pretty  bool
 
-	digest *Digest
+	digest   *Digest
+	fsys     fs.FS
+	cache    *Cache
+	progress *Progress
+	sending  bool
+	plan     *Plan
+	filter   func(string) bool
+	flush    bool
 }
 
+// errSkipped is returned for the files that scanDirectory does not count
+// because they were scanned before the scan was interrupted.
+var errSkipped = errors.New("skipped")
+
 func NewScanner(alg, list string, opts ...Option) (*Scanner, error) {
+	return newScanner(alg, list, false, opts...)
+}
+
+func ResumeScanner(alg, list string, opts ...Option) (*Scanner, error) {
+	return newScanner(alg, list, true, opts...)
+}
+
+func newScanner(alg, list string, resume bool, opts ...Option) (*Scanner, error) {
 	var (
-		s Scanner
+		s = Scanner{list: list}
 		w = ioutil.Discard
 	)
+
+	var err error
+	if s.digest, err = NewDigest(alg); err != nil {
+		return nil, err
+	}
+	if resume && list == "" {
+		return nil, fmt.Errorf("no list to resume the scan")
+	}
 	if list != "" {
-		f, err := os.Create(list)
+		if resume {
+			s.resume, err = loadCheckpoint(checkpointFile(list), alg)
+			if err != nil {
+				return nil, err
+			}
+			if s.resume == nil {
+				return nil, fmt.Errorf("%s: no checkpoint to resume the scan", list)
+			}
+		}
+		if s.resume != nil {
+			s.file, err = s.resume.reopen(list, s.digest)
+		} else {
+			s.file, err = os.Create(list)
+		}
 		if err != nil {
 			return nil, err
 		}
-		s.closer, w = f, f
+		s.closer, w = s.file, s.file
+		if _, err := s.digest.State(); err == nil {
+			s.state = &checkpoint{Alg: alg}
+		}
 	}
 	s.inner = bufio.NewWriter(w)
 
-	var err error
+	if s.resume == nil {
+		buf := make([]byte, 16)
+		copy(buf, alg)
+		if _, err := s.inner.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range opts {
+		o(&s)
+	}
+
+	return &s, nil
+}
+
+// newScannerTo returns a scanner writing its list to w. Each file is sent as
+// soon as it has been scanned.
+func newScannerTo(alg string, w io.Writer) (*Scanner, error) {
+	var (
+		s   Scanner
+		err error
+	)
 	if s.digest, err = NewDigest(alg); err != nil {
 		return nil, err
 	}
+	s.inner = bufio.NewWriter(w)
+	s.flush = true
 
 	buf := make([]byte, 16)
 	copy(buf, alg)
 	if _, err := s.inner.Write(buf); err != nil {
 		return nil, err
 	}
-
-	for _, o := range opts {
-		o(&s)
-	}
-
 	return &s, nil
 }
 
@@ -65,58 +135,247 @@ func (s *Scanner) Synchronize(client *Client, base, pattern string, sync, verbos
 		}
 		return errors.Is(err, ErrFile) || errors.Is(err, ErrSum) || errors.Is(err, ErrSize)
 	}
-	base = filepath.Clean(base)
-	cz, err := s.scanDirectory(base, pattern, func(e Entry) error {
+	if sync && s.plan == nil {
+		s.sendProgress(client)
+		defer s.sendProgress(nil)
+	}
+	p := newPipeline(client)
+	cz, err := s.scanDirectory(base, pattern, func(e Entry, name string) error {
+		if err := p.Err(); err != nil {
+			return err
+		}
 		file := e.File
-		if err := e.Compute(s.digest); err != nil {
+		if err := s.compute(e); err != nil {
 			return err
 		}
-		e.File = strings.TrimPrefix(e.File, base)
-		err := client.Check(e, s.digest.Local())
-		if canCopy(err) {
-			err = client.Copy(file, e, s.digest.Local())
+		e.File = name
+		sum := s.digest.Local()
+		cl, err := client.pick().check(e, sum)
+		if err != nil {
+			return err
 		}
-		if err == nil && verbose {
-			s.dumpEntry(e)
+		p.push(cl, func(err error) error {
+			switch {
+			case !canCopy(err):
+				if err == nil && s.plan != nil {
+					s.plan.add(Identical, e, sum)
+				}
+				if err == nil && s.sending {
+					s.progress.complete(e.Size)
+				}
+				if err == nil && verbose {
+					s.dumpEntry(e, sum)
+				}
+				return err
+			case s.plan != nil:
+				s.plan.add(planStatus(err), e, sum)
+				return nil
+			}
+			missing := errors.Is(err, ErrFile)
+			r := client.pick().start(func(c *Client) (*call, error) {
+				if missing {
+					return c.copy(file, e, sum)
+				}
+				return nil, c.Delta(file, e, sum)
+			})
+			p.then(r, func(err error) error {
+				if err == nil && missing {
+					s.progress.complete(0)
+				} else if err == nil {
+					s.progress.complete(e.Size)
+				}
+				if err == nil && verbose {
+					s.dumpEntry(e, sum)
+				}
+				return err
+			})
+			return nil
+		})
+		if e.fsys != nil {
+			p.sync()
 		}
-		return err
+		return nil
 	})
-	if err == nil {
+	if perr := p.close(); err == nil {
+		err = perr
+	}
+	if err == nil && (s.plan == nil || !sync) {
 		err = client.Compare(cz, s.digest.Global())
 	}
 	return cz, err
 }
 
 func (s *Scanner) Transfer(client *Client, base, pattern string, verbose bool) (Coze, error) {
-	base = filepath.Clean(base)
-	cz, err := s.scanDirectory(base, pattern, func(e Entry) error {
-		if err := e.Compute(s.digest); err != nil {
+	if s.plan == nil {
+		s.sendProgress(client)
+		defer s.sendProgress(nil)
+	}
+	p := newPipeline(client)
+	cz, err := s.scanDirectory(base, pattern, func(e Entry, name string) error {
+		if err := p.Err(); err != nil {
+			return err
+		}
+		if err := s.compute(e); err != nil {
 			return err
 		}
 		file := e.File
-		e.File = strings.TrimPrefix(e.File, base)
-		return client.Copy(file, e, s.digest.Local())
+		e.File = name
+		if s.plan != nil {
+			sum := s.digest.Local()
+			cl, err := client.pick().check(e, sum)
+			if err != nil {
+				return err
+			}
+			p.push(cl, func(err error) error {
+				if err != nil && !errors.Is(err, ErrFile) && !errors.Is(err, ErrSum) && !errors.Is(err, ErrSize) {
+					return err
+				}
+				s.plan.add(planStatus(err), e, sum)
+				return nil
+			})
+			return nil
+		}
+		sum := s.digest.Local()
+		client.seq.reserve(remoteName(name))
+		r := client.pick().start(func(c *Client) (*call, error) {
+			return c.copy(file, e, sum)
+		})
+		p.then(r, func(err error) error {
+			if err == nil {
+				s.progress.complete(0)
+			}
+			return err
+		})
+		if e.fsys != nil {
+			p.sync()
+		}
+		return nil
 	})
-	if err == nil {
+	if perr := p.close(); err == nil {
+		err = perr
+	}
+	if err == nil && s.plan == nil {
 		err = client.Compare(cz, s.digest.Global())
 	}
 	return cz, err
 }
 
+// planStatus returns the action performed on a file given the result of its
+// check: files missing on the server are copied, the files that differ are
+// overwritten and the others are left unchanged.
+func planStatus(err error) byte {
+	switch {
+	case err == nil:
+		return Identical
+	case errors.Is(err, ErrFile):
+		return Added
+	default:
+		return Modified
+	}
+}
+
+func (s *Scanner) Fetch(client *Client, base, pattern string, verbose bool) (Coze, error) {
+	var cz Coze
+	list, err := client.List(pattern)
+	if err != nil {
+		return cz, err
+	}
+	for _, e := range list {
+		s.progress.update(e.File)
+		if err := s.fetch(client, base, e); err != nil {
+			return cz, err
+		}
+		if verbose {
+			s.dumpEntry(e, s.digest.Local())
+		}
+		s.progress.complete(e.Size)
+		cz.Update(e.Size)
+		s.digest.Reset()
+	}
+	return cz, client.Compare(cz, s.digest.Global())
+}
+
+func (s *Scanner) fetch(client *Client, base string, e Entry) error {
+	if err := validName(e.File); err != nil {
+		return err
+	}
+	file := filepath.Join(base, filepath.FromSlash(e.File))
+	if err := os.MkdirAll(filepath.Dir(file), dirMode&^DefaultUmask); err != nil {
+		return err
+	}
+	w, err := createTempFile(file)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(w.Name())
+	defer w.Close()
+
+	sum, err := client.Fetch(e, io.MultiWriter(w, s.progress.writerTo(s.digest)))
+	if err != nil {
+		return err
+	}
+	if local := s.digest.Local(); !bytes.Equal(sum, local) {
+		return fmt.Errorf("%w: invalid digest %s (%x != %x)", ErrSum, e.File, sum, local)
+	}
+	s.digest.commit()
+	if err := w.Chmod(fileMode &^ DefaultUmask); err != nil {
+		return err
+	}
+	if err := w.Sync(); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.Name(), file)
+}
+
 func (s *Scanner) Scan(base, pattern string) (Coze, error) {
-	base = filepath.Clean(base)
-	cz, err := s.scanDirectory(base, pattern, func(e Entry) error {
-		if err := e.Compute(s.digest); err != nil {
+	cz, skip, last, err := s.resumeDirectory(base, pattern)
+	if err != nil || skip < 0 {
+		return cz, err
+	}
+	resumed := skip > 0
+	s.state.begin(base, pattern)
+	s.state.restore(skip, last, cz)
+	rest, err := s.scanDirectory(base, pattern, func(e Entry, name string) error {
+		if skip > 0 {
+			skip--
+			if skip == 0 && name != last {
+				return fmt.Errorf("%s: can not resume scan (%s has been modified)", base, last)
+			}
+			return errSkipped
+		}
+		if err := s.compute(e); err != nil {
 			return err
 		}
 		if s.verbose {
-			s.dumpEntry(e)
+			s.dumpEntry(e, s.digest.Local())
+		}
+		if err := s.dumpCurrentState(e, name); err != nil {
+			return err
 		}
-		return s.dumpCurrentState(e, base)
+		s.state.update(name, e.Size)
+		return s.checkpoint(false)
 	})
+	if resumed {
+		cz = cz.Merge(rest)
+	} else {
+		cz = rest
+	}
+	if err == nil && skip > 0 {
+		err = fmt.Errorf("%s: can not resume scan (files have been removed)", base)
+	}
 	if err == nil {
 		err = s.dumpFinalState(cz)
 	}
+	if err == nil {
+		s.state.end(cz)
+		err = s.checkpoint(true)
+	}
+	if err != nil {
+		s.failed = true
+	}
 	return cz, err
 }
 
@@ -125,30 +384,113 @@ func (s *Scanner) Close() error {
 	if s.closer != nil {
 		err = s.closer.Close()
 	}
+	if s.state != nil && !s.failed {
+		os.Remove(checkpointFile(s.list))
+	}
 	return err
 }
 
-func (s *Scanner) scanDirectory(base, pattern string, fn func(e Entry) error) (Coze, error) {
-	var cz Coze
-	queue, err := FetchFiles(base, pattern)
+func (s *Scanner) scanDirectory(base, pattern string, fn func(e Entry, name string) error) (Coze, error) {
+	var (
+		cz   Coze
+		fsys = s.fsys
+	)
+	if fsys == nil && IsArchive(base) {
+		a, err := OpenArchive(base)
+		if err != nil {
+			return cz, err
+		}
+		defer a.Close()
+		fsys, base = a, "."
+	}
+	base = cleanPath(fsys, base)
+	queue, err := FetchFilesFS(fsys, base, pattern)
 	if err != nil {
 		return cz, err
 	}
+	// the files not processed are drained before the archive is closed so
+	// that the walk of the files ends.
+	defer func() {
+		for range queue {
+		}
+	}()
 	for e := range queue {
-		if err := fn(e); err != nil {
+		if s.filter != nil && !s.filter(e.File) {
+			continue
+		}
+		name := relativePath(fsys, e.File, base)
+		s.progress.update(name)
+		if err := fn(e, name); err != nil {
+			if err == errSkipped {
+				continue
+			}
 			return cz, err
 		}
+		if !s.sending {
+			s.progress.complete(e.Size)
+		}
 		cz.Update(e.Size)
 		s.digest.Reset()
 	}
 	return cz, nil
 }
 
-func (s *Scanner) dumpEntry(e Entry) {
+// sendProgress makes the progress of the scanner follow the bytes sent by
+// client instead of the bytes read to compute the digests. A nil client
+// restores the default.
+func (s *Scanner) sendProgress(client *Client) {
+	s.sending = client != nil && s.progress != nil
+	if client == nil {
+		return
+	}
+	client.progress = s.progress
+	for _, c := range client.peers {
+		c.progress = s.progress
+	}
+}
+
+// compute computes the digest of the file of e and adds it to the global
+// digest. The digest is taken from the cache when the file has not changed
+// since it was last hashed.
+func (s *Scanner) compute(e Entry) error {
+	if err := s.computeLocal(e); err != nil {
+		return err
+	}
+	s.digest.commit()
+	return nil
+}
+
+func (s *Scanner) computeLocal(e Entry) error {
+	var w io.Writer = s.digest
+	if !s.sending {
+		w = s.progress.writerTo(s.digest)
+	}
+	if s.cache == nil || e.fsys != nil || e.info == nil {
+		return e.Compute(w)
+	}
+	var (
+		file = e.File
+		key  = cacheKeyOf(e.info)
+	)
+	if f, err := filepath.Abs(file); err == nil {
+		file = f
+	}
+	if sum, ok := s.cache.lookup(file, key); ok {
+		s.digest.setLocal(sum)
+		return nil
+	}
+	if err := e.Compute(w); err != nil {
+		return err
+	}
+	s.cache.store(file, key, s.digest.Local())
+	return nil
+}
+
+func (s *Scanner) dumpEntry(e Entry, sum []byte) {
 	if s.pretty {
-		fmt.Printf("%-8s  %x  %s\n", FormatSize(e.Size), s.digest.Local(), e.File)
+		fmt.Printf("%-8s  %x  %s\n", FormatSize(e.Size), sum, e.File)
 	} else {
-		fmt.Printf("%-12d  %x  %s\n", int64(e.Size), s.digest.Local(), e.File)
+		fmt.Printf("%-12d  %x  %s\n", int64(e.Size), sum, e.File)
 	}
 }
 
@@ -160,17 +502,16 @@ func (s *Scanner) dumpFinalState(cz Coze) error {
 	return s.inner.Flush()
 }
 
-func (s *Scanner) dumpCurrentState(e Entry, base string) error {
-	var (
-		file = strings.TrimPrefix(e.File, base)
-		raw  = []byte(file)
-	)
+func (s *Scanner) dumpCurrentState(e Entry, file string) error {
+	raw := []byte(file)
 	binary.Write(s.inner, binary.BigEndian, e.Size)
 	s.inner.Write(s.digest.Global())
 	s.inner.Write(s.digest.Local())
 	binary.Write(s.inner, binary.BigEndian, uint16(len(raw)))
-	_, err := s.inner.Write(raw)
-	return err
+	if _, err := s.inner.Write(raw); err != nil || !s.flush {
+		return err
+	}
+	return s.inner.Flush()
 }
 
 func (s *Scanner) setVerbose(v bool) { s.verbose = v }
@@ -178,3 +519,11 @@ func (s *Scanner) setVerbose(v bool) { s.verbose = v }
 func (s *Scanner) setPretty(v bool) { s.pretty = v }
 
 func (s *Scanner) setError(v bool) {}
+
+func (s *Scanner) setFS(fsys fs.FS) { s.fsys = fsys }
+
+func (s *Scanner) setCache(c *Cache) { s.cache = c }
+
+func (s *Scanner) setProgress(p *Progress) { s.progress = p }
+
+func (s *Scanner) setPlan(p *Plan) { s.plan = p }
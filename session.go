@@ -0,0 +1,190 @@
+package achile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// WithConnections opens n connections to the server. Files are distributed
+// over the connections and the server merges the files received on all the
+// connections in a single session, so that they can be compared as a whole.
+func WithConnections(n int) ClientOption {
+	return func(c *Client) {
+		if n > 0 {
+			c.conns = n
+		}
+	}
+}
+
+// sequence gives to each file sent by the client, whatever the connection
+// used, its position in the global digest of the session.
+type sequence struct {
+	mu    sync.Mutex
+	pos   uint64
+	retry map[string]uint64
+}
+
+func newSequence() *sequence {
+	return &sequence{
+		retry: make(map[string]uint64),
+	}
+}
+
+func (s *sequence) next(name string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pos, ok := s.retry[name]; ok {
+		delete(s.retry, name)
+		return pos
+	}
+	pos := s.pos
+	s.pos++
+	return pos
+}
+
+// reserve gives its position to a file before it is sent, so that the files
+// sent in the background keep the order in which they were reserved.
+func (s *sequence) reserve(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.retry[name]; ok {
+		return
+	}
+	s.retry[name] = s.pos
+	s.pos++
+}
+
+func (s *sequence) keep(name string, pos uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retry[name] = pos
+}
+
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (c *Client) dialPeers(addr string) error {
+	for i := 1; i < c.conns; i++ {
+		p := Client{
+			alg:         c.alg,
+			hashlen:     c.hashlen,
+			window:      c.window,
+			timeout:     c.timeout,
+			dialTimeout: c.dialTimeout,
+			compress:    c.compress,
+			skip:        c.skip,
+			metadata:    c.metadata,
+			tls:         c.tls,
+			user:        c.user,
+			token:       c.token,
+			share:       c.share,
+			session:     c.session,
+			seq:         c.seq,
+			calls:       make(map[uint32]*call),
+			quit:        make(chan struct{}),
+		}
+		if err := p.dial(addr); err != nil {
+			return err
+		}
+		c.peers = append(c.peers, &p)
+	}
+	return nil
+}
+
+// pick returns the connection to use for the next file.
+func (c *Client) pick() *Client {
+	if len(c.peers) == 0 {
+		return c
+	}
+	n := atomic.AddUint32(&c.turn, 1) % uint32(len(c.peers)+1)
+	if n == 0 {
+		return c
+	}
+	return c.peers[n-1]
+}
+
+// session is the state shared by the handlers of the connections opened by
+// a client: the files received and the global digest made of the digests of
+// their contents.
+type session struct {
+	key  string
+	refs int
+
+	mu      sync.Mutex
+	digest  *Digest
+	cz      Coze
+	next    uint64
+	pending map[uint64]pendingFile
+}
+
+var sessions = struct {
+	sync.Mutex
+	groups map[string]*session
+}{
+	groups: make(map[string]*session),
+}
+
+func newSession(digest *Digest) *session {
+	return &session{
+		digest:  digest,
+		pending: make(map[uint64]pendingFile),
+	}
+}
+
+// joinSession returns the session identified by id, creating it if it does
+// not exist yet. An empty id gives a session private to the handler.
+func joinSession(base, id, alg string) (*session, error) {
+	if id == "" {
+		d, err := NewDigest(alg)
+		if err != nil {
+			return nil, err
+		}
+		return newSession(d), nil
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	key := base + "\x00" + strings.ToLower(alg) + "\x00" + id
+	if s, ok := sessions.groups[key]; ok {
+		s.refs++
+		return s, nil
+	}
+	d, err := NewDigest(alg)
+	if err != nil {
+		return nil, err
+	}
+	s := newSession(d)
+	s.key, s.refs = key, 1
+	sessions.groups[key] = s
+	return s, nil
+}
+
+func (s *session) leave() {
+	if s == nil || s.key == "" {
+		return
+	}
+	sessions.Lock()
+	defer sessions.Unlock()
+	if s.refs--; s.refs <= 0 {
+		delete(sessions.groups, s.key)
+	}
+}
+
+func validSessionID(id string) error {
+	if id == "" {
+		return nil
+	}
+	if b, err := hex.DecodeString(id); err != nil || len(b) < 16 {
+		return fmt.Errorf("%w: invalid session %q", ErrProtocol, id)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package achile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrShare = errors.New("no such share")
+
+// Share is a directory of the server that the clients select by name during
+// the handshake. Algs, when set, restricts the algorithms that the clients can
+// use and Users, when set, replaces the users of the handler.
+type Share struct {
+	Name  string
+	Base  string
+	Mode  Mode
+	Algs  []string
+	Users map[string]string
+}
+
+// WithShares lets the clients select one of shares. The clients that do not
+// select a share use the base directory of the handler, unless it is empty.
+func WithShares(shares ...Share) HandlerOption {
+	return func(h *Handler) {
+		h.shares = make(map[string]Share)
+		for _, s := range shares {
+			h.shares[s.Name] = s
+		}
+	}
+}
+
+// WithShare selects the share of the server used by the client. The share can
+// also be given at the end of the address of the server, as in host:port/share.
+func WithShare(name string) ClientOption {
+	return func(c *Client) {
+		c.share = name
+	}
+}
+
+func splitShare(addr string) (string, string) {
+	if x := strings.IndexByte(addr, '/'); x >= 0 {
+		return addr[:x], addr[x+1:]
+	}
+	return addr, ""
+}
+
+func (c *Client) checkShare(params map[string]string) error {
+	if c.share != "" && params["share"] != c.share {
+		return fmt.Errorf("%w: %s (server does not support shares)", ErrShare, c.share)
+	}
+	return nil
+}
+
+func (h *Handler) selectShare(name string, res *hello) error {
+	if name == "" {
+		if h.base == "" {
+			return fmt.Errorf("%w: a share has to be selected", ErrShare)
+		}
+		return nil
+	}
+	s, ok := h.shares[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrShare, name)
+	}
+	if len(s.Algs) > 0 {
+		res.Algs = s.Algs
+		var found bool
+		for _, a := range s.Algs {
+			found = found || strings.EqualFold(a, h.alg)
+		}
+		if !found {
+			return fmt.Errorf("%w: %s (supported: %s)", ErrAlg, h.alg, strings.Join(s.Algs, ", "))
+		}
+	}
+	h.base = s.Base
+	if s.Mode > h.mode {
+		h.mode = s.Mode
+	}
+	if s.Users != nil {
+		h.users = s.Users
+	}
+	res.Params["share"] = s.Name
+	return nil
+}
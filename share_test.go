@@ -0,0 +1,46 @@
+package achile
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestShareSelect(t *testing.T) {
+	var (
+		src    = filepath.Join(t.TempDir(), "file")
+		data   = []byte("content of file")
+		sum    = sha256.Sum256(data)
+		shares = []Share{
+			{Name: "a", Base: t.TempDir()},
+			{Name: "b", Base: t.TempDir()},
+		}
+	)
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr := serve(t, "", nil, WithShares(shares...))
+
+	c, err := NewClient(addr+"/b", "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Copy(src, Entry{File: "file", Size: float64(len(data))}, sum[:]); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(shares[1].Base, "file")); err != nil {
+		t.Errorf("file not copied to the selected share: %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(shares[0].Base, "file")); err == nil {
+		t.Errorf("file copied to another share")
+	}
+
+	for _, a := range []string{addr, addr + "/c"} {
+		if c, err := NewClient(a, "sha256"); err == nil {
+			c.Close()
+			t.Errorf("%s: client accepted without a valid share", a)
+		}
+	}
+}
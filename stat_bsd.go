@@ -0,0 +1,25 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package achile
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+func statInode(i fs.FileInfo) (uint64, int64) {
+	st, ok := i.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(st.Ino), st.Ctimespec.Nano()
+}
+
+func statOwner(i fs.FileInfo) (int, int) {
+	st, ok := i.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, -1
+	}
+	return int(st.Uid), int(st.Gid)
+}
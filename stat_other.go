@@ -0,0 +1,16 @@
+//go:build !linux && !openbsd && !darwin && !freebsd && !netbsd
+// +build !linux,!openbsd,!darwin,!freebsd,!netbsd
+
+package achile
+
+import (
+	"io/fs"
+)
+
+func statInode(i fs.FileInfo) (uint64, int64) {
+	return 0, 0
+}
+
+func statOwner(i fs.FileInfo) (int, int) {
+	return -1, -1
+}